@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/apikey"
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/caller"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The /api-keys routes are guarded by caller.Middleware, so they can be used
+// with an access token or, to list and revoke keys, with an API key.
+
+// apiKeyNameMaxLength bounds the name users give their keys
+const apiKeyNameMaxLength = 100
+
+// APIKeyRequest is the body accepted when creating an API key
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is optional; keys without it are valid until revoked
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// createdAPIKey is the only answer that carries the key itself
+type createdAPIKey struct {
+	apikey.Key
+	Secret string `json:"key"`
+}
+
+// createAPIKey issues an API key for the caller. Keys cannot create keys, so
+// that a leaked key cannot be used to create others.
+func createAPIKey(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	user := caller.From(c)
+	if user.Key != nil {
+		return response.New(response.CodeForbidden, "API keys cannot create API keys")
+	}
+	request := new(APIKeyRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+
+	var fields []response.FieldError
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len([]rune(request.Name)) > apiKeyNameMaxLength {
+		fields = append(fields, response.FieldError{Field: "name", Code: response.CodeFieldOutOfRange, Message: "name must be 1 to 100 characters"})
+	}
+	slices.Sort(request.Scopes)
+	request.Scopes = slices.Compact(request.Scopes)
+	if len(request.Scopes) == 0 {
+		fields = append(fields, response.FieldError{Field: "scopes", Code: response.CodeFieldRequired, Message: "at least one scope is required"})
+	}
+	for _, scope := range request.Scopes {
+		if scope != apikey.ScopeRead && scope != apikey.ScopeWrite {
+			fields = append(fields, response.FieldError{Field: "scopes", Code: response.CodeFieldNotAllowed, Message: "scope must be read or write"})
+			break
+		}
+	}
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		fields = append(fields, response.FieldError{Field: "expires_at", Code: response.CodeFieldOutOfRange, Message: "expires_at must be in the future"})
+	}
+	if len(fields) > 0 {
+		return response.Invalid(fields...)
+	}
+
+	key, secret, err := apiKeys.Create(ctx, tenant.FromContext(ctx).ID, user.UserID, request.Name, request.Scopes, request.ExpiresAt)
+	if err != nil {
+		return response.Internal(err, "Error creating API key")
+	}
+
+	event := audit.FromRequest(c, audit.APIKeyCreated, user.UserID)
+	event.Details = map[string]string{"key_id": key.ID.String(), "name": key.Name, "scopes": strings.Join(key.Scopes, ",")}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusCreated, "", createdAPIKey{Key: key, Secret: secret})
+}
+
+// listAPIKeys lists the caller's keys, without the keys themselves
+func listAPIKeys(c *fiber.Ctx) error {
+	keys, err := apiKeys.List(c.UserContext(), caller.From(c).UserID)
+	if err != nil {
+		return response.Internal(err, "Error listing API keys")
+	}
+	if keys == nil {
+		keys = []apikey.Key{}
+	}
+
+	return response.Success(c, fiber.StatusOK, "", keys)
+}
+
+// revokeAPIKey deletes one of the caller's keys; a key may revoke itself
+func revokeAPIKey(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	user := caller.From(c)
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid API key ID")
+	}
+
+	err = apiKeys.Revoke(ctx, user.UserID, id)
+	if errors.Is(err, apikey.ErrNotFound) {
+		return response.New(response.CodeNotFound, "API key not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error revoking API key")
+	}
+
+	event := audit.FromRequest(c, audit.APIKeyRevoked, user.UserID)
+	event.Details = map[string]string{"key_id": id.String()}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusOK, "API key revoked", nil)
+}
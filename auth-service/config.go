@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+)
+
+// Config is the auth-service configuration, see config.Load for its sources
+type Config struct {
+	HTTP      config.HTTP      `yaml:"http"`
+	Log       config.Log       `yaml:"log"`
+	Tracing   config.Tracing   `yaml:"tracing"`
+	Cassandra config.Cassandra `yaml:"cassandra"`
+	Webhooks  config.Webhooks  `yaml:"webhooks"`
+	SMTP      config.SMTP      `yaml:"smtp"`
+	JWT       JWTConfig        `yaml:"jwt"`
+	MagicLink MagicLinkConfig  `yaml:"magic_link"`
+	// EmailCodes configures the one-time sign-in codes
+	EmailCodes config.EmailCodes `yaml:"email_codes"`
+	OIDC       OIDCConfig        `yaml:"oidc"`
+	LDAP       LDAPConfig        `yaml:"ldap"`
+	Tenancy    config.Tenancy    `yaml:"tenancy"`
+
+	// PublicURL is the base URL used in links sent to users
+	PublicURL string `yaml:"public_url" env:"PUBLIC_URL" required:"true"`
+}
+
+// JWTConfig configures token signing and lifetimes
+type JWTConfig struct {
+	Secret          string        `yaml:"secret" env:"JWT_SECRET" required:"true"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl" env:"ACCESS_TOKEN_TTL" required:"true"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl" env:"REFRESH_TOKEN_TTL" required:"true"`
+}
+
+// MagicLinkConfig configures passwordless sign-in links
+type MagicLinkConfig struct {
+	TTL time.Duration `yaml:"ttl" env:"MAGIC_LINK_TTL" required:"true"`
+	// At most RequestLimit links are sent to an address per RequestWindow
+	RequestLimit  int           `yaml:"request_limit" env:"MAGIC_LINK_REQUEST_LIMIT" required:"true"`
+	RequestWindow time.Duration `yaml:"request_window" env:"MAGIC_LINK_REQUEST_WINDOW" required:"true"`
+}
+
+// OIDCConfig configures sign-in through external OpenID Connect providers.
+// Providers can only be set in the configuration file.
+type OIDCConfig struct {
+	// Providers are keyed by the name used in the /login/oidc/:provider routes
+	Providers map[string]OIDCProvider `yaml:"providers"`
+	// StateTTL bounds how long a user may take to sign in at the provider
+	StateTTL time.Duration `yaml:"state_ttl" env:"OIDC_STATE_TTL" required:"true"`
+}
+
+// OIDCProvider configures one OpenID Connect identity provider
+type OIDCProvider struct {
+	// DiscoveryURL is the provider's /.well-known/openid-configuration URL
+	DiscoveryURL string   `yaml:"discovery_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+	// RedirectURL defaults to <PUBLIC_URL>/login/oidc/<name>/callback
+	RedirectURL string `yaml:"redirect_url"`
+}
+
+// discoverySuffix is appended to the issuer URL to find its discovery document
+const discoverySuffix = "/.well-known/openid-configuration"
+
+// Issuer returns the issuer URL the discovery document belongs to
+func (p OIDCProvider) Issuer() string {
+	return strings.TrimSuffix(p.DiscoveryURL, discoverySuffix)
+}
+
+func (o OIDCConfig) Validate() error {
+	for name, provider := range o.Providers {
+		if !strings.HasSuffix(provider.DiscoveryURL, discoverySuffix) {
+			return fmt.Errorf("oidc provider %q: discovery_url must end in %s", name, discoverySuffix)
+		}
+		if provider.ClientID == "" {
+			return fmt.Errorf("oidc provider %q: client_id is required", name)
+		}
+	}
+	return nil
+}
+
+// LDAPConfig configures login against an LDAP or Active Directory server for
+// users without a local password. It is disabled when URL is empty.
+type LDAPConfig struct {
+	// URL is e.g. ldaps://ldap.example.com or ldap://ldap.example.com:389
+	URL      string `yaml:"url" env:"LDAP_URL"`
+	StartTLS bool   `yaml:"start_tls" env:"LDAP_START_TLS"`
+	// InsecureSkipVerify disables certificate checks, for test servers only
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify" env:"LDAP_INSECURE_SKIP_VERIFY"`
+	Timeout            time.Duration `yaml:"timeout" env:"LDAP_TIMEOUT"`
+
+	// BindDN and BindPassword are the service account that searches for users;
+	// the search is anonymous when BindDN is empty
+	BindDN       string `yaml:"bind_dn" env:"LDAP_BIND_DN"`
+	BindPassword string `yaml:"bind_password" env:"LDAP_BIND_PASSWORD"`
+
+	// BaseDN is where users are searched for
+	BaseDN string `yaml:"base_dn" env:"LDAP_BASE_DN"`
+	// UserFilter finds a user by the escaped username substituted for %s,
+	// e.g. (sAMAccountName=%s) for Active Directory
+	UserFilter     string `yaml:"user_filter" env:"LDAP_USER_FILTER"`
+	EmailAttribute string `yaml:"email_attribute" env:"LDAP_EMAIL_ATTRIBUTE"`
+
+	// Groups are read from GroupAttribute of the user, e.g. memberOf, unless
+	// GroupFilter is set; then groups are searched for under GroupBaseDN,
+	// with the escaped DN of the user substituted for %s, e.g. (member=%s)
+	GroupAttribute string `yaml:"group_attribute" env:"LDAP_GROUP_ATTRIBUTE"`
+	GroupFilter    string `yaml:"group_filter" env:"LDAP_GROUP_FILTER"`
+	GroupBaseDN    string `yaml:"group_base_dn" env:"LDAP_GROUP_BASE_DN"`
+	// GroupRoles maps group DNs to the roles their members get. It can only
+	// be set in the configuration file.
+	GroupRoles map[string][]string `yaml:"group_roles"`
+}
+
+func (l LDAPConfig) Validate() error {
+	if l.URL == "" {
+		return nil
+	}
+	if l.BaseDN == "" {
+		return fmt.Errorf("LDAP_BASE_DN is required when LDAP_URL is set")
+	}
+	if strings.Count(l.UserFilter, "%s") != 1 {
+		return fmt.Errorf("LDAP_USER_FILTER must contain %%s exactly once, got %q", l.UserFilter)
+	}
+	if l.GroupFilter != "" && strings.Count(l.GroupFilter, "%s") != 1 {
+		return fmt.Errorf("LDAP_GROUP_FILTER must contain %%s exactly once, got %q", l.GroupFilter)
+	}
+	if l.Timeout <= 0 {
+		return fmt.Errorf("LDAP_TIMEOUT must be positive")
+	}
+	return nil
+}
+
+var cfg = Config{
+	HTTP:      config.HTTP{Port: 3001, ShutdownTimeout: 15 * time.Second},
+	Log:       config.Log{Level: "info"},
+	Tracing:   config.Tracing{Exporter: "none"},
+	Cassandra: config.DefaultCassandra(),
+	Webhooks:  config.DefaultWebhooks(),
+	SMTP:      config.DefaultSMTP(),
+	JWT: JWTConfig{
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 7 * 24 * time.Hour,
+	},
+	MagicLink: MagicLinkConfig{
+		TTL:           15 * time.Minute,
+		RequestLimit:  5,
+		RequestWindow: time.Hour,
+	},
+	EmailCodes: config.DefaultEmailCodes(),
+	OIDC:       OIDCConfig{StateTTL: 10 * time.Minute},
+	LDAP: LDAPConfig{
+		Timeout:        10 * time.Second,
+		UserFilter:     "(uid=%s)",
+		EmailAttribute: "mail",
+		GroupAttribute: "memberOf",
+	},
+	Tenancy:   config.DefaultTenancy(),
+	PublicURL: "http://localhost:3000",
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// errUsernameClaimed is returned when a directory user's name was claimed by
+// another account between looking it up and provisioning the shadow record
+var errUsernameClaimed = errors.New("username claimed by another account")
+
+// loginWithDirectory checks a password against the directory and issues
+// tokens for the user's shadow record, which is created on first login.
+// existing is the shadow record if there already is one.
+func loginWithDirectory(c *fiber.Ctx, username, password string, existing *User) error {
+	ctx := c.UserContext()
+	// A name that could never be registered cannot get a shadow record either
+	normalized, err := identity.NormalizeUsername(username)
+	var entry *DirectoryUser
+	if err != nil {
+		err = ErrInvalidCredentials
+	} else {
+		entry, err = directory.Authenticate(ctx, normalized, password)
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		var userID gocql.UUID
+		if existing != nil {
+			userID = existing.ID
+		}
+		metrics.Outcome(metrics.OutcomeBadPassword)
+		event := audit.FromRequest(c, audit.LoginFailed, userID)
+		event.Details = map[string]string{"username": username, "reason": metrics.OutcomeBadPassword, "method": directory.Source()}
+		auditLog.Record(ctx, event)
+		return response.New(response.CodeInvalidCredentials, "Invalid username or password")
+	}
+	if err != nil {
+		return response.Wrap(response.CodeUnavailable, err, "Directory is unavailable")
+	}
+
+	user, err := provisionDirectoryUser(c, normalized, entry, existing)
+	if errors.Is(err, errUsernameClaimed) {
+		return response.New(response.CodeUsernameTaken, "Username already exists")
+	}
+	if err != nil {
+		return response.Internal(err, "Error signing in")
+	}
+
+	if tag, ok := i18n.Parse(user.Locale); ok {
+		i18n.SetLocale(c, tag)
+	}
+
+	if err := ensureActive(c, user.ID, directory.Source()); err != nil {
+		return err
+	}
+
+	metrics.Outcome(metrics.OutcomeLoginSuccess)
+	event := audit.FromRequest(c, audit.LoginSucceeded, user.ID)
+	event.Details = map[string]string{"method": directory.Source()}
+	auditLog.Record(ctx, event)
+	return issueTokens(c, user.ID)
+}
+
+// provisionDirectoryUser creates the shadow record of a directory user, or
+// refreshes the roles of an existing one so that tokens carry the user's
+// current groups
+func provisionDirectoryUser(c *fiber.Ctx, username string, entry *DirectoryUser, existing *User) (User, error) {
+	ctx := c.UserContext()
+	if existing != nil {
+		err := session.Query(`UPDATE users SET roles = ? WHERE id = ?`, entry.Roles, existing.ID).WithContext(ctx).Exec()
+		return *existing, err
+	}
+
+	user := User{ID: gocql.TimeUUID(), Username: username, AuthSource: directory.Source(), Roles: entry.Roles}
+	t := tenant.FromContext(ctx)
+	claimed, err := session.Query(`INSERT INTO tenant_users_by_username (tenant, username, user_id) VALUES (?, ?, ?) IF NOT EXISTS`, t.ID, identity.UsernameKey(username), user.ID).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return User{}, err
+	}
+	// The claim may be a local registration in progress, so it is never taken
+	// over; a concurrent first login of the same user is found next time
+	if !claimed {
+		return User{}, errUsernameClaimed
+	}
+	created := false
+	defer func() {
+		if !created {
+			release(ctx, "tenant_users_by_username", "username", identity.UsernameKey(username), user.ID)
+		}
+	}()
+
+	// The address is only recorded if no other account has claimed it
+	if email, err := identity.NormalizeEmail(entry.Email); err == nil {
+		user.Email, err = claimDirectoryEmail(ctx, email, user.ID)
+		if err != nil {
+			return User{}, err
+		}
+		if user.Email == "" {
+			logging.FromCtx(c).Warn("Directory user's email address belongs to another account", "user_id", user.ID)
+		}
+	}
+	defer func() {
+		if !created && user.Email != "" {
+			release(ctx, "tenant_users_by_email", "email", identity.EmailKey(user.Email), user.ID)
+		}
+	}()
+
+	// The directory vouches for the address, so it counts as verified
+	err = session.Query(`INSERT INTO users (id, tenant, username, email, email_verified, auth_source, roles, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, t.ID, user.Username, user.Email, user.Email != "", user.AuthSource, user.Roles, time.Now()).WithContext(ctx).Exec()
+	if err != nil {
+		return User{}, err
+	}
+	created = true
+	publishRegistered(c, user, user.AuthSource)
+	return user, nil
+}
+
+// claimDirectoryEmail claims email for userID in the tenant in ctx and
+// returns it, or returns "" if another account holds it
+func claimDirectoryEmail(ctx context.Context, email string, userID gocql.UUID) (string, error) {
+	claimed, err := session.Query(`INSERT INTO tenant_users_by_email (tenant, email, user_id) VALUES (?, ?, ?) IF NOT EXISTS`,
+		tenant.FromContext(ctx).ID, identity.EmailKey(email), userID).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{}))
+	if err != nil || !claimed {
+		return "", err
+	}
+	return email, nil
+}
@@ -1,7 +1,19 @@
 package main
 
 import (
+	"errors"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
 	"github.com/bdobrica/LLMDesignedApp/go-common/auth"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tracing"
+	"github.com/bdobrica/LLMDesignedApp/go-common/userstatus"
+	"github.com/bdobrica/LLMDesignedApp/go-common/webhook"
+	"github.com/gocql/gocql"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -11,44 +23,113 @@ func login(c *fiber.Ctx) error {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
+	ctx := c.UserContext()
 	if err := c.BodyParser(&data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": false, "message": "Invalid request"})
+		return response.New(response.CodeBadRequest, "Invalid request")
 	}
 
-	// Find user in Cassandra
+	// Find user in Cassandra, resolving the username through its lookup table
 	var user User
-	err := session.Query(`SELECT id, password FROM users WHERE username = ?`, data.Username).
-		Scan(&user.ID, &user.Password)
+	err := session.Query(`SELECT user_id FROM tenant_users_by_username WHERE tenant = ? AND username = ?`,
+		tenant.FromContext(ctx).ID, identity.UsernameKey(data.Username)).WithContext(ctx).Scan(&user.ID)
+	if err == nil {
+		err = session.Query(`SELECT id, password, locale, auth_source FROM users WHERE id = ?`, user.ID).WithContext(ctx).
+			Scan(&user.ID, &user.Password, &user.Locale, &user.AuthSource)
+	}
+	if err != nil && err != gocql.ErrNotFound {
+		return response.Internal(err, "Error retrieving user")
+	}
+
+	// Users unknown here and shadow records of directory users are checked
+	// against the directory
+	if directory != nil && (err == gocql.ErrNotFound || user.AuthSource == directory.Source()) {
+		var existing *User
+		if err == nil {
+			existing = &user
+		}
+		return loginWithDirectory(c, data.Username, data.Password, existing)
+	}
+
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": false, "message": "Invalid email or password"})
+		metrics.Outcome(metrics.OutcomeUnknownUser)
+		event := audit.FromRequest(c, audit.LoginFailed, gocql.UUID{})
+		event.Actor = ""
+		event.Details = map[string]string{"username": data.Username, "reason": metrics.OutcomeUnknownUser}
+		auditLog.Record(ctx, event)
+		return response.New(response.CodeInvalidCredentials, "Invalid username or password")
 	}
 
 	// Check password
-	if !auth.CheckPasswordHash(data.Password, user.Password) {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": false, "message": "Invalid email or password"})
+	_, span := tracing.Start(ctx, "auth.CheckPasswordHash")
+	passwordOK := auth.CheckPasswordHash(data.Password, user.Password)
+	span.End()
+	if !passwordOK {
+		metrics.Outcome(metrics.OutcomeBadPassword)
+		event := audit.FromRequest(c, audit.LoginFailed, user.ID)
+		event.Details = map[string]string{"reason": metrics.OutcomeBadPassword}
+		auditLog.Record(ctx, event)
+		return response.New(response.CodeInvalidCredentials, "Invalid username or password")
+	}
+
+	// Answer in the user's preferred language once the password checks out;
+	// doing so earlier would reveal which usernames exist
+	if tag, ok := i18n.Parse(user.Locale); ok {
+		i18n.SetLocale(c, tag)
+	}
+	if err := ensureActive(c, user.ID, ""); err != nil {
+		return err
+	}
+
+	metrics.Outcome(metrics.OutcomeLoginSuccess)
+	auditLog.Record(ctx, audit.FromRequest(c, audit.LoginSucceeded, user.ID))
+	return issueTokens(c, user.ID)
+}
+
+// ensureActive returns an error ready to be returned by a handler unless the
+// account of userID may sign in, and records the refused sign-in. Callers
+// check the user's credentials first, so that only the user learns the
+// status of their account. method is the method detail of the audit event.
+func ensureActive(c *fiber.Ctx, userID gocql.UUID, method string) error {
+	ctx := c.UserContext()
+	status, err := userstatus.Load(ctx, session, userID)
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error signing in")
+	}
+	if status == userstatus.Active {
+		return nil
 	}
 
+	metrics.Outcome(metrics.OutcomeAccountDisabled)
+	event := audit.FromRequest(c, audit.LoginFailed, userID)
+	event.Details = map[string]string{"reason": string(status)}
+	if method != "" {
+		event.Details["method"] = method
+	}
+	auditLog.Record(ctx, event)
+	return userstatus.Error(status)
+}
+
+// issueTokens answers a successful sign-in with a new access and refresh token
+func issueTokens(c *fiber.Ctx, userID gocql.UUID) error {
 	// Generate JWT
-	jwtToken, err := GenerateJWT(user.ID)
+	jwtToken, err := GenerateJWT(c.UserContext(), userID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": false, "message": "Error generating token"})
+		return response.Internal(err, "Error generating token")
 	}
 
 	// Generate Refresh Token
-	refreshToken, err := GenerateRefreshToken(user.ID)
+	refreshToken, err := GenerateRefreshToken(c.UserContext(), userID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": false, "message": "Error generating refresh token"})
-	}
-
-	// Return tokens
-	return c.JSON(fiber.Map{
-		"status":  true,
-		"message": "Login successful",
-		"data": fiber.Map{
-			"access_token":  jwtToken,
-			"refresh_token": refreshToken,
-			"expires_in":    900, // 15 minutes in seconds
-		},
+		return response.Internal(err, "Error generating refresh token")
+	}
+
+	return response.Success(c, fiber.StatusOK, "Login successful", fiber.Map{
+		"access_token":  jwtToken,
+		"refresh_token": refreshToken,
+		"expires_in":    int(cfg.JWT.AccessTokenTTL.Seconds()),
 	})
 }
 
@@ -57,29 +138,41 @@ func refreshToken(c *fiber.Ctx) error {
 	var data struct {
 		Token string `json:"refresh_token"`
 	}
+	ctx := c.UserContext()
 	if err := c.BodyParser(&data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": false, "message": "Invalid request"})
+		return response.New(response.CodeBadRequest, "Invalid request")
 	}
 
 	// Validate refresh token
-	userID, err := ValidateRefreshToken(data.Token)
+	userID, err := ValidateRefreshToken(ctx, data.Token)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"status": false, "message": "Invalid or expired refresh token"})
+		var disabled *response.Error
+		if errors.As(err, &disabled) {
+			metrics.Outcome(metrics.OutcomeAccountDisabled)
+			return disabled
+		}
+		if errors.Is(err, ErrRefreshTokenExpired) {
+			metrics.Outcome(metrics.OutcomeRefreshExpired)
+			return response.New(response.CodeTokenExpired, "Refresh token expired")
+		}
+		metrics.Outcome(metrics.OutcomeRefreshInvalid)
+		if err != gocql.ErrNotFound {
+			return response.Internal(err, "Error validating refresh token")
+		}
+		return response.New(response.CodeTokenInvalid, "Invalid refresh token")
 	}
 
 	// Generate new JWT
-	jwtToken, err := GenerateJWT(userID)
+	jwtToken, err := GenerateJWT(ctx, userID)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": false, "message": "Error generating token"})
+		return response.Internal(err, "Error generating token")
 	}
 
-	return c.JSON(fiber.Map{
-		"status":  true,
-		"message": "Token refreshed",
-		"data": fiber.Map{
-			"access_token": jwtToken,
-			"expires_in":   900, // 15 minutes in seconds
-		},
+	metrics.Outcome(metrics.OutcomeRefreshSuccess)
+	auditLog.Record(ctx, audit.FromRequest(c, audit.TokenRefreshed, userID))
+	return response.Success(c, fiber.StatusOK, "Token refreshed", fiber.Map{
+		"access_token": jwtToken,
+		"expires_in":   int(cfg.JWT.AccessTokenTTL.Seconds()),
 	})
 }
 
@@ -88,17 +181,30 @@ func logout(c *fiber.Ctx) error {
 	var data struct {
 		Token string `json:"refresh_token"`
 	}
+	ctx := c.UserContext()
 	if err := c.BodyParser(&data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": false, "message": "Invalid request"})
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+
+	// Find who the token belongs to, for its listing and the audit log.
+	// Unknown tokens and those of other tenants are left alone, with the
+	// same answer as a successful logout.
+	userID, err := RefreshTokenOwner(ctx, data.Token)
+	if err == gocql.ErrNotFound {
+		metrics.Outcome(metrics.OutcomeLogout)
+		return response.Success(c, fiber.StatusOK, "Logged out successfully", nil)
+	}
+	if err != nil {
+		return response.Internal(err, "Error revoking token")
 	}
 
 	// Revoke refresh token
-	if err := RevokeRefreshToken(data.Token); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": false, "message": "Error revoking token"})
+	if err := RevokeRefreshToken(ctx, userID, data.Token); err != nil {
+		return response.Internal(err, "Error revoking token")
 	}
 
-	return c.JSON(fiber.Map{
-		"status":  true,
-		"message": "Logged out successfully",
-	})
+	metrics.Outcome(metrics.OutcomeLogout)
+	auditLog.Record(ctx, audit.FromRequest(c, audit.LoggedOut, userID))
+	webhooks.Publish(ctx, webhook.SessionRevoked, fiber.Map{"user_id": userID, "reason": "logout"})
+	return response.Success(c, fiber.StatusOK, "Logged out successfully", nil)
 }
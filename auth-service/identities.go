@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/webhook"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	// errIdentityEmailTaken is returned when the provider's email address
+	// belongs to a local account but the provider has not verified it, so
+	// the identity cannot be linked to that account
+	errIdentityEmailTaken = errors.New("email address belongs to another account")
+	// errIdentityNoEmail is returned when a new account would have to be
+	// created but the provider shared no usable email address
+	errIdentityNoEmail = errors.New("identity has no email address")
+)
+
+// resolveIdentity returns the local user linked to subject at provider. An
+// unknown identity is linked to the account with the same email address if
+// the provider verified that address, or else to a new account. Links left
+// behind by deleted accounts are dropped and the identity is linked anew.
+func resolveIdentity(c *fiber.Ctx, provider, subject string, claims oidcClaims) (gocql.UUID, error) {
+	ctx := c.UserContext()
+	t := tenant.FromContext(ctx)
+	var userID gocql.UUID
+	err := session.Query(`SELECT user_id FROM tenant_user_identities WHERE tenant = ? AND provider = ? AND subject = ?`, t.ID, provider, subject).WithContext(ctx).Scan(&userID)
+	if err == nil {
+		err = session.Query(`SELECT id FROM users WHERE id = ?`, userID).WithContext(ctx).Scan(&userID)
+		if err != gocql.ErrNotFound {
+			return userID, err
+		}
+		if err := unlinkIdentity(ctx, provider, subject, userID); err != nil {
+			return gocql.UUID{}, err
+		}
+	} else if err != gocql.ErrNotFound {
+		return gocql.UUID{}, err
+	}
+
+	email, err := identity.NormalizeEmail(claims.Email)
+	if err != nil {
+		return gocql.UUID{}, errIdentityNoEmail
+	}
+
+	err = session.Query(`SELECT user_id FROM tenant_users_by_email WHERE tenant = ? AND email = ?`, t.ID, identity.EmailKey(email)).WithContext(ctx).Scan(&userID)
+	switch {
+	case err == nil && claims.EmailVerified:
+		userID, err = linkIdentity(ctx, provider, subject, email, userID)
+		if err == nil {
+			event := audit.FromRequest(c, audit.IdentityLinked, userID)
+			event.Details = map[string]string{"provider": provider}
+			auditLog.Record(ctx, event)
+		}
+		return userID, err
+	case err == nil:
+		return gocql.UUID{}, errIdentityEmailTaken
+	case err != gocql.ErrNotFound:
+		return gocql.UUID{}, err
+	}
+
+	user, err := createFederatedUser(ctx, email, claims)
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	linkedID, err := linkIdentity(ctx, provider, subject, email, user.ID)
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	publishRegistered(c, user, provider)
+	return linkedID, nil
+}
+
+// linkIdentity links subject at provider to userID, in the tenant in ctx,
+// and returns the user it
+// ends up linked to, which differs from userID if a concurrent sign-in of
+// the same identity won the race
+func linkIdentity(ctx context.Context, provider, subject, email string, userID gocql.UUID) (gocql.UUID, error) {
+	now := time.Now()
+	existing := make(map[string]interface{})
+	applied, err := session.Query(`INSERT INTO tenant_user_identities (tenant, provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
+		tenant.FromContext(ctx).ID, provider, subject, userID, email, now).WithContext(ctx).MapScanCAS(existing)
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	if !applied {
+		linked, _ := existing["user_id"].(gocql.UUID)
+		return linked, nil
+	}
+
+	err = session.Query(`INSERT INTO user_identities_by_user (user_id, provider, subject, created_at) VALUES (?, ?, ?, ?)`,
+		userID, provider, subject, now).WithContext(ctx).Exec()
+	return userID, err
+}
+
+// unlinkIdentity removes the link of subject at provider to userID, in the
+// tenant in ctx, unless it was linked to another user in the meantime
+func unlinkIdentity(ctx context.Context, provider, subject string, userID gocql.UUID) error {
+	_, err := session.Query(`DELETE FROM tenant_user_identities WHERE tenant = ? AND provider = ? AND subject = ? IF user_id = ?`,
+		tenant.FromContext(ctx).ID, provider, subject, userID).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return err
+	}
+	return session.Query(`DELETE FROM user_identities_by_user WHERE user_id = ? AND provider = ? AND subject = ?`, userID, provider, subject).WithContext(ctx).Exec()
+}
+
+// createFederatedUser creates an account without a password for someone
+// signing in with a provider for the first time. The username is derived
+// from the claims and made unique if needed.
+func createFederatedUser(ctx context.Context, email string, claims oidcClaims) (User, error) {
+	user := User{ID: gocql.TimeUUID(), Email: email}
+	t := tenant.FromContext(ctx)
+
+	claimed, err := session.Query(`INSERT INTO tenant_users_by_email (tenant, email, user_id) VALUES (?, ?, ?) IF NOT EXISTS`, t.ID, identity.EmailKey(email), user.ID).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return User{}, err
+	}
+	if !claimed {
+		// Registered in the meantime; linking is left to the next sign-in
+		return User{}, errIdentityEmailTaken
+	}
+	created := false
+	defer func() {
+		if !created {
+			release(ctx, "tenant_users_by_email", "email", identity.EmailKey(email), user.ID)
+		}
+	}()
+
+	user.Username, err = claimFederatedUsername(ctx, claims, email, user.ID)
+	if err != nil {
+		return User{}, err
+	}
+	defer func() {
+		if !created {
+			release(ctx, "tenant_users_by_username", "username", identity.UsernameKey(user.Username), user.ID)
+		}
+	}()
+
+	err = session.Query(`INSERT INTO users (id, tenant, username, email, email_verified, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		user.ID, t.ID, user.Username, user.Email, claims.EmailVerified, time.Now()).WithContext(ctx).Exec()
+	if err != nil {
+		return User{}, err
+	}
+	created = true
+	return user, nil
+}
+
+// claimFederatedUsername claims a username based on the preferred username
+// or the local part of the email address, adding a random suffix while the
+// name is taken
+func claimFederatedUsername(ctx context.Context, claims oidcClaims, email string, userID gocql.UUID) (string, error) {
+	base := usernameBase(claims.PreferredUsername)
+	if base == "" {
+		local, _, _ := strings.Cut(email, "@")
+		base = usernameBase(local)
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	candidate := base
+	for attempt := 0; attempt < 5; attempt++ {
+		if username, err := identity.NormalizeUsername(candidate); err == nil {
+			claimed, err := session.Query(`INSERT INTO tenant_users_by_username (tenant, username, user_id) VALUES (?, ?, ?) IF NOT EXISTS`,
+				tenant.FromContext(ctx).ID, identity.UsernameKey(username), userID).WithContext(ctx).
+				MapScanCAS(make(map[string]interface{}))
+			if err != nil {
+				return "", err
+			}
+			if claimed {
+				return username, nil
+			}
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s-%04d", base, n.Int64())
+	}
+	return "", errors.New("no free username found")
+}
+
+// usernameBase strips raw down to characters allowed in usernames, leaving
+// room for a suffix
+func usernameBase(raw string) string {
+	var b strings.Builder
+	for _, r := range raw {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case (r == '.' || r == '_' || r == '-') && b.Len() > 0:
+			b.WriteRune(r)
+		}
+	}
+	base := []rune(b.String())
+	if maxLength := identity.UsernameMaxLength - 5; len(base) > maxLength {
+		base = base[:maxLength]
+	}
+	if len(base) < identity.UsernameMinLength {
+		return ""
+	}
+	return string(base)
+}
+
+// release frees a lookup claim in the tenant in ctx, but only if userID
+// still holds it
+func release(ctx context.Context, table, column, key string, userID gocql.UUID) {
+	if _, err := session.Query(`DELETE FROM `+table+` WHERE tenant = ? AND `+column+` = ? IF user_id = ?`, tenant.FromContext(ctx).ID, key, userID).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{})); err != nil {
+		slog.Error("Error releasing claim", "table", table, "user_id", userID, "error", err)
+	}
+}
+
+// publishRegistered announces a user created on first sign-in with a
+// provider or directory
+func publishRegistered(c *fiber.Ctx, user User, provider string) {
+	ctx := c.UserContext()
+	metrics.Outcome(metrics.OutcomeRegistered)
+	event := audit.FromRequest(c, audit.UserRegistered, user.ID)
+	event.Details = map[string]string{"provider": provider}
+	auditLog.Record(ctx, event)
+	webhooks.Publish(ctx, webhook.UserRegistered, fiber.Map{"user_id": user.ID, "username": user.Username, "email": user.Email})
+}
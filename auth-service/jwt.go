@@ -1,41 +1,79 @@
 package main
 
 import (
-	"log"
-	"os"
+	"context"
+	"fmt"
 	"time"
 
+	"github.com/bdobrica/LLMDesignedApp/go-common/health"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
 	"github.com/gocql/gocql"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// GenerateJWT generates a new JWT token for the user
-func GenerateJWT(userID gocql.UUID) (string, error) {
-	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
-	if len(jwtSecret) == 0 {
-		log.Println("JWT_SECRET environment variable not set")
-		return "", jwt.ErrInvalidKeyType
+// GenerateJWT generates a new JWT token for the user, issued by and signed
+// with the key of the tenant in ctx. The user's current roles, if any, are
+// carried in the roles claim, and the user's organizations, if any, in the
+// orgs claim, which maps organization IDs to the user's role in each.
+func GenerateJWT(ctx context.Context, userID gocql.UUID) (string, error) {
+	t := tenant.FromContext(ctx)
+	var roles []string
+	if err := session.Query(`SELECT roles FROM users WHERE id = ?`, userID).WithContext(ctx).Scan(&roles); err != nil {
+		return "", err
 	}
+	orgs, err := organizationRoles(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
 	claims := jwt.MapClaims{
+		"iss":     t.Issuer,
 		"user_id": userID,
-		"exp":     time.Now().Add(15 * time.Minute).Unix(), // Access token valid for 15 minutes
+		"exp":     time.Now().Add(cfg.JWT.AccessTokenTTL).Unix(),
+	}
+	if len(roles) > 0 {
+		claims["roles"] = roles
+	}
+	if len(orgs) > 0 {
+		claims["orgs"] = orgs
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return token.SignedString([]byte(t.JWTSecret))
 }
 
-// ParseJWT validates the token and returns the claims
-func ParseJWT(tokenStr string) (jwt.MapClaims, error) {
-	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
-	if len(jwtSecret) == 0 {
-		log.Println("JWT_SECRET environment variable not set")
-		return nil, jwt.ErrInvalidKeyType
+// organizationRoles returns the user's role in each of the organizations,
+// which user-management keeps, that the user is a member of
+func organizationRoles(ctx context.Context, userID gocql.UUID) (map[string]string, error) {
+	orgs := make(map[string]string)
+	var (
+		orgID gocql.UUID
+		role  string
+	)
+	iter := session.Query(`SELECT org_id, role FROM organization_memberships_by_user WHERE user_id = ?`, userID).WithContext(ctx).Iter()
+	for iter.Scan(&orgID, &role) {
+		orgs[orgID.String()] = role
 	}
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
+	return orgs, iter.Close()
+}
+
+// signingKeyCheck reports whether every tenant has a key that access tokens
+// can be signed and verified with
+func signingKeyCheck(tenants *tenant.Registry) health.Check {
+	return func(context.Context) error {
+		for _, t := range tenants.All() {
+			if t.JWTSecret == "" {
+				return fmt.Errorf("tenant %s has no JWT signing key", t.ID)
+			}
+			key := []byte(t.JWTSecret)
+			signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": t.Issuer}).SignedString(key)
+			if err != nil {
+				return fmt.Errorf("tenant %s cannot sign tokens: %w", t.ID, err)
+			}
+			parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(t.Issuer))
+			if _, err := parser.Parse(signed, func(*jwt.Token) (interface{}, error) { return key, nil }); err != nil {
+				return fmt.Errorf("tenant %s cannot verify tokens: %w", t.ID, err)
+			}
+		}
+		return nil
 	}
-	return nil, err
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/tracing"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator for unknown users and
+// wrong passwords alike
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks passwords against a directory of users kept outside
+// Cassandra. Users it accepts get a shadow record in users, with auth_source
+// set to its Source, so that refresh tokens and sessions work as for local
+// users.
+type Authenticator interface {
+	// Source names the authenticator in users.auth_source
+	Source() string
+	// Authenticate checks the password of username and returns the user's
+	// directory entry
+	Authenticate(ctx context.Context, username, password string) (*DirectoryUser, error)
+}
+
+// DirectoryUser is a user as found in a directory
+type DirectoryUser struct {
+	Email string
+	// Roles are mapped from the user's groups
+	Roles []string
+}
+
+// authSourceLDAP marks the shadow records of LDAP users
+const authSourceLDAP = "ldap"
+
+// ldapAuthenticator authenticates by searching for the user with a service
+// account and binding with the user's DN and password
+type ldapAuthenticator struct {
+	config LDAPConfig
+}
+
+func (a *ldapAuthenticator) Source() string {
+	return authSourceLDAP
+}
+
+func (a *ldapAuthenticator) Authenticate(ctx context.Context, username, password string) (user *DirectoryUser, err error) {
+	_, span := tracing.Start(ctx, "ldap.authenticate")
+	defer func() {
+		// A rejected login is not a failure of the directory
+		if errors.Is(err, ErrInvalidCredentials) {
+			tracing.End(span, nil)
+		} else {
+			tracing.End(span, err)
+		}
+	}()
+
+	// An empty password would make the bind below an unauthenticated bind,
+	// which servers accept for any DN
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := a.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{a.config.EmailAttribute, a.config.GroupAttribute}, nil))
+	if err != nil {
+		return nil, err
+	}
+	// Unknown and ambiguous usernames are both rejected
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	groups := entry.GetAttributeValues(a.config.GroupAttribute)
+	if a.config.GroupFilter != "" {
+		if groups, err = a.searchGroups(conn, entry.DN); err != nil {
+			return nil, err
+		}
+	}
+	return &DirectoryUser{
+		Email: entry.GetAttributeValue(a.config.EmailAttribute),
+		Roles: a.roles(groups),
+	}, nil
+}
+
+// dial connects to the server, upgrading the connection with StartTLS when configured
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(a.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: a.config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.config.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.config.Timeout)
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bindServiceAccount binds as the service account, if there is one
+func (a *ldapAuthenticator) bindServiceAccount(conn *ldap.Conn) error {
+	if a.config.BindDN == "" {
+		return nil
+	}
+	return conn.Bind(a.config.BindDN, a.config.BindPassword)
+}
+
+// searchGroups returns the DNs of the groups userDN is a member of. The
+// search runs as the service account, as users may not be allowed to list
+// groups themselves.
+func (a *ldapAuthenticator) searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	if err := a.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+	baseDN := a.config.GroupBaseDN
+	if baseDN == "" {
+		baseDN = a.config.BaseDN
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(a.config.GroupFilter, ldap.EscapeFilter(userDN)),
+		[]string{"dn"}, nil))
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// roles maps group DNs to sorted roles. DNs are compared the way LDAP does,
+// so case and spacing do not matter.
+func (a *ldapAuthenticator) roles(groups []string) []string {
+	var roles []string
+	seen := make(map[string]bool)
+	for groupDN, groupRoles := range a.config.GroupRoles {
+		mapped, err := ldap.ParseDN(groupDN)
+		if err != nil {
+			continue
+		}
+		for _, group := range groups {
+			parsed, err := ldap.ParseDN(group)
+			if err != nil || !parsed.EqualFold(mapped) {
+				continue
+			}
+			for _, role := range groupRoles {
+				if !seen[role] {
+					seen[role] = true
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
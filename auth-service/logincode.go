@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/emailcode"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// loginCodeSent is the answer to every well-formed request, whether or not
+// the address belongs to an account, so that addresses cannot be probed
+const loginCodeSent = "If the address belongs to an account, a code has been sent to it"
+
+// requestLoginCode emails a one-time sign-in code, the alternative to a
+// magic link for native apps
+func requestLoginCode(c *fiber.Ctx) error {
+	var data struct {
+		Email string `json:"email"`
+	}
+	ctx := c.UserContext()
+	if err := c.BodyParser(&data); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	email, err := identity.NormalizeEmail(data.Email)
+	if err != nil {
+		return response.Invalid(response.Field("email", err))
+	}
+
+	// Limit the codes sent to an address, whether or not it has an account
+	t := tenant.FromContext(ctx)
+	allowed, err := emailCodeLimiter.Allow(ctx, t.Key(identity.EmailKey(email)))
+	if err != nil {
+		return response.Internal(err, "Error sending code")
+	}
+	if !allowed {
+		metrics.Outcome(metrics.OutcomeRateLimited)
+		return response.New(response.CodeRateLimited, "Too many requests, please try again later")
+	}
+
+	var user User
+	err = session.Query(`SELECT user_id FROM tenant_users_by_email WHERE tenant = ? AND email = ?`, t.ID, identity.EmailKey(email)).WithContext(ctx).Scan(&user.ID)
+	if err == nil {
+		err = session.Query(`SELECT id, email, locale FROM users WHERE id = ?`, user.ID).WithContext(ctx).Scan(&user.ID, &user.Email, &user.Locale)
+	}
+	if err == gocql.ErrNotFound {
+		metrics.Outcome(metrics.OutcomeUnknownUser)
+		return response.Success(c, fiber.StatusAccepted, loginCodeSent, nil)
+	}
+	if err != nil {
+		return response.Internal(err, "Error sending code")
+	}
+
+	code, err := emailCodes.Issue(ctx, t.ID, emailcode.Login, identity.EmailKey(email), user.ID)
+	if err != nil {
+		return response.Internal(err, "Error sending code")
+	}
+
+	// The email is written in the user's language, falling back to the request's
+	tag, ok := i18n.Parse(user.Locale)
+	if !ok {
+		tag = i18n.Locale(c)
+	}
+	subject, body := emailCodes.Message(tag, emailcode.Login, code)
+	// A delivery failure is only logged; answering differently would reveal the account
+	if err := mailer.Send(ctx, user.Email, subject, body); err != nil {
+		logging.FromCtx(c).Error("Error sending code", "user_id", user.ID, "error", err)
+	} else {
+		metrics.Outcome(metrics.OutcomeEmailCodeSent)
+		event := audit.FromRequest(c, audit.EmailCodeSent, user.ID)
+		event.Details = map[string]string{"purpose": string(emailcode.Login)}
+		auditLog.Record(ctx, event)
+	}
+
+	return response.Success(c, fiber.StatusAccepted, loginCodeSent, nil)
+}
+
+// loginWithCode exchanges an address and the code sent to it for tokens, like login
+func loginWithCode(c *fiber.Ctx) error {
+	var data struct {
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+	ctx := c.UserContext()
+	if err := c.BodyParser(&data); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	email, err := identity.NormalizeEmail(data.Email)
+	if err != nil {
+		return response.Invalid(response.Field("email", err))
+	}
+
+	userID, err := emailCodes.Check(ctx, tenant.FromContext(ctx).ID, emailcode.Login, identity.EmailKey(email), data.Code)
+	switch {
+	case errors.Is(err, emailcode.ErrInvalidCode):
+		metrics.Outcome(metrics.OutcomeEmailCodeBad)
+		return response.New(response.CodeCodeInvalid, "Invalid or expired code")
+	case errors.Is(err, emailcode.ErrTooManyAttempts):
+		metrics.Outcome(metrics.OutcomeEmailCodeBad)
+		return response.New(response.CodeCodeAttempts, "Too many attempts, please request a new code")
+	case err != nil:
+		return response.Internal(err, "Error signing in")
+	}
+
+	if err := ensureActive(c, userID, "email_code"); err != nil {
+		return err
+	}
+
+	metrics.Outcome(metrics.OutcomeEmailCodeLogin)
+	event := audit.FromRequest(c, audit.LoginSucceeded, userID)
+	event.Details = map[string]string{"method": "email_code"}
+	auditLog.Record(ctx, event)
+	return issueTokens(c, userID)
+}
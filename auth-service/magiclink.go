@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/auth"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
+)
+
+// magicLinkSent is the answer to every well-formed request, whether or not
+// the address belongs to an account, so that addresses cannot be probed
+const magicLinkSent = "If the address belongs to an account, a sign-in link has been sent to it"
+
+// requestMagicLink emails a single-use sign-in link to the owner of an address
+func requestMagicLink(c *fiber.Ctx) error {
+	var data struct {
+		Email string `json:"email"`
+	}
+	ctx := c.UserContext()
+	if err := c.BodyParser(&data); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	email, err := identity.NormalizeEmail(data.Email)
+	if err != nil {
+		return response.Invalid(response.Field("email", err))
+	}
+
+	// Limit the links sent to an address, whether or not it has an account
+	t := tenant.FromContext(ctx)
+	allowed, err := magicLinkLimiter.Allow(ctx, t.Key(identity.EmailKey(email)))
+	if err != nil {
+		return response.Internal(err, "Error sending sign-in link")
+	}
+	if !allowed {
+		metrics.Outcome(metrics.OutcomeRateLimited)
+		return response.New(response.CodeRateLimited, "Too many requests, please try again later")
+	}
+
+	var user User
+	err = session.Query(`SELECT user_id FROM tenant_users_by_email WHERE tenant = ? AND email = ?`, t.ID, identity.EmailKey(email)).WithContext(ctx).Scan(&user.ID)
+	if err == nil {
+		err = session.Query(`SELECT id, email, locale FROM users WHERE id = ?`, user.ID).WithContext(ctx).Scan(&user.ID, &user.Email, &user.Locale)
+	}
+	if err == gocql.ErrNotFound {
+		metrics.Outcome(metrics.OutcomeUnknownUser)
+		return response.Success(c, fiber.StatusAccepted, magicLinkSent, nil)
+	}
+	if err != nil {
+		return response.Internal(err, "Error sending sign-in link")
+	}
+
+	token, err := createMagicLink(ctx, user.ID)
+	if err != nil {
+		return response.Internal(err, "Error sending sign-in link")
+	}
+
+	// The email is written in the user's language, falling back to the request's
+	tag, ok := i18n.Parse(user.Locale)
+	if !ok {
+		tag = i18n.Locale(c)
+	}
+	// A delivery failure is only logged; answering differently would reveal the account
+	if err := sendMagicLinkEmail(ctx, user.Email, token, tag); err != nil {
+		logging.FromCtx(c).Error("Error sending sign-in link", "user_id", user.ID, "error", err)
+	} else {
+		metrics.Outcome(metrics.OutcomeMagicLinkSent)
+		auditLog.Record(ctx, audit.FromRequest(c, audit.MagicLinkSent, user.ID))
+	}
+
+	return response.Success(c, fiber.StatusAccepted, magicLinkSent, nil)
+}
+
+// magicLinkCallback exchanges the token of a sign-in link for tokens, like login
+func magicLinkCallback(c *fiber.Ctx) error {
+	var data struct {
+		Token string `json:"token"`
+	}
+	ctx := c.UserContext()
+	if err := c.BodyParser(&data); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+
+	userID, err := consumeMagicLink(ctx, data.Token)
+	if err == gocql.ErrNotFound {
+		metrics.Outcome(metrics.OutcomeMagicLinkBad)
+		return response.New(response.CodeTokenInvalid, "Invalid or expired sign-in link")
+	}
+	if err != nil {
+		return response.Internal(err, "Error signing in")
+	}
+
+	if err := ensureActive(c, userID, "magic_link"); err != nil {
+		return err
+	}
+
+	metrics.Outcome(metrics.OutcomeMagicLinkLogin)
+	event := audit.FromRequest(c, audit.LoginSucceeded, userID)
+	event.Details = map[string]string{"method": "magic_link"}
+	auditLog.Record(ctx, event)
+	return issueTokens(c, userID)
+}
+
+// createMagicLink stores a new sign-in token for userID, valid in the tenant
+// in ctx, and returns it. Only its hash is stored.
+func createMagicLink(ctx context.Context, userID gocql.UUID) (string, error) {
+	token, err := auth.GenerateBase64RandomToken(43)
+	if err != nil {
+		return "", err
+	}
+	err = session.Query(`INSERT INTO magic_links (token_hash, user_id, tenant, expires_at) VALUES (?, ?, ?, ?) USING TTL ?`,
+		hashToken(token), userID, tenant.FromContext(ctx).ID, time.Now().Add(cfg.MagicLink.TTL), int(cfg.MagicLink.TTL.Seconds())).WithContext(ctx).Exec()
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeMagicLink deletes a sign-in token and returns its user. The delete is
+// a lightweight transaction, so a token is only ever accepted once. Unknown,
+// used and expired tokens, and tokens of other tenants, all yield
+// gocql.ErrNotFound.
+func consumeMagicLink(ctx context.Context, token string) (gocql.UUID, error) {
+	var userID gocql.UUID
+	var tenantID string
+	var expiresAt time.Time
+	err := session.Query(`SELECT user_id, tenant, expires_at FROM magic_links WHERE token_hash = ?`, hashToken(token)).WithContext(ctx).
+		Scan(&userID, &tenantID, &expiresAt)
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	if tenant.Stored(tenantID) != tenant.FromContext(ctx).ID {
+		return gocql.UUID{}, gocql.ErrNotFound
+	}
+
+	applied, err := session.Query(`DELETE FROM magic_links WHERE token_hash = ? IF EXISTS`, hashToken(token)).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	if !applied || time.Now().After(expiresAt) {
+		return gocql.UUID{}, gocql.ErrNotFound
+	}
+	return userID, nil
+}
+
+// sendMagicLinkEmail sends a sign-in link in the language tag
+func sendMagicLinkEmail(ctx context.Context, to, token string, tag language.Tag) error {
+	link := fmt.Sprintf("%s/login/magic/%s", tenant.FromContext(ctx).PublicURL, token)
+
+	subject := i18n.Translate(tag, "Your sign-in link")
+	body := fmt.Sprintf(`
+        <h1>%s</h1>
+        <p>%s</p>
+        <a href="%s">%s</a>
+    `, html.EscapeString(subject),
+		html.EscapeString(fmt.Sprintf(i18n.Translate(tag, "Click the following link to sign in. It can only be used once and expires in %d minutes."), int(cfg.MagicLink.TTL.Minutes()))),
+		link,
+		html.EscapeString(i18n.Translate(tag, "Sign in")))
+
+	return mailer.Send(ctx, to, subject, body)
+}
+
+// hashToken returns the form in which a sign-in token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
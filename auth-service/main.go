@@ -1,39 +1,186 @@
 package main
 
 import (
+	"context"
+	_ "embed"
 	"log"
+	"log/slog"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 
+	"github.com/bdobrica/LLMDesignedApp/go-common/apikey"
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/caller"
+	"github.com/bdobrica/LLMDesignedApp/go-common/cassandra"
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+	"github.com/bdobrica/LLMDesignedApp/go-common/emailcode"
+	"github.com/bdobrica/LLMDesignedApp/go-common/health"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/mail"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/openapi"
+	"github.com/bdobrica/LLMDesignedApp/go-common/ratelimit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/schema"
+	"github.com/bdobrica/LLMDesignedApp/go-common/server"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tracing"
+	"github.com/bdobrica/LLMDesignedApp/go-common/webhook"
 	"github.com/gocql/gocql"
 	"github.com/gofiber/fiber/v2"
 )
 
-var session *gocql.Session
+// openapiDocument describes every route of the service
+//
+//go:embed openapi.yaml
+var openapiDocument []byte
+
+var (
+	session  *gocql.Session
+	auditLog *audit.Recorder
+	webhooks *webhook.Dispatcher
+	mailer   mail.Sender
+
+	magicLinkLimiter *ratelimit.Limiter
+	emailCodes       *emailcode.Store
+	emailCodeLimiter *ratelimit.Limiter
+	oidcProviders    map[string]*oidcProvider
+	// directory authenticates users without a local password; nil when not configured
+	directory Authenticator
+	apiKeys   *apikey.Store
+	tenants   *tenant.Registry
+)
 
 func main() {
-	// Initialize Cassandra session
-	var err error
-	session, err = initCassandra()
+	// Load and validate configuration before touching any dependency
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal("Invalid configuration:\n", err)
+	}
+
+	logger, err := logging.Setup("auth-service", cfg.Log.Level)
+	if err != nil {
+		log.Fatal("Failed to set up logging:", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "auth-service", cfg.Tracing)
 	if err != nil {
-		log.Fatal("Failed to connect to Cassandra:", err)
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	// SIGINT and SIGTERM cancel ctx, which starts the graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Initialize Cassandra session, waiting for it to come up if needed
+	cluster := cfg.Cassandra.NewCluster()
+	cluster.QueryObserver = cassandra.QueryObservers{metrics.CassandraObserver{}, tracing.CassandraObserver{}}
+	cluster.BatchObserver = cassandra.BatchObservers{metrics.CassandraObserver{}, tracing.CassandraObserver{}}
+	session, err = cassandra.Connect(ctx, cluster, cassandra.Backoff{Total: cfg.Cassandra.ConnectTimeout})
+	if err != nil {
+		slog.Error("Failed to connect to Cassandra", "error", err)
+		os.Exit(1)
 	}
 	defer session.Close()
+	auditLog = &audit.Recorder{Session: session}
+	webhooks = webhook.NewDispatcher(session, cfg.Webhooks)
+	mailer = mail.Sender{Config: cfg.SMTP}
+	magicLinkLimiter = &ratelimit.Limiter{
+		Session: session,
+		Name:    "magic_link",
+		Limit:   cfg.MagicLink.RequestLimit,
+		Window:  cfg.MagicLink.RequestWindow,
+	}
+	emailCodes = &emailcode.Store{Session: session, Config: cfg.EmailCodes}
+	oidcProviders = newOIDCProviders(cfg.OIDC.Providers)
+	if cfg.LDAP.URL != "" {
+		directory = &ldapAuthenticator{config: cfg.LDAP}
+	}
+	emailCodeLimiter = &ratelimit.Limiter{
+		Session: session,
+		Name:    "login_code",
+		Limit:   cfg.EmailCodes.RequestLimit,
+		Window:  cfg.EmailCodes.RequestWindow,
+	}
+	apiKeys = &apikey.Store{Session: session}
+	tenants = tenant.NewRegistry(cfg.Tenancy, config.Tenant{
+		JWTSecret:   cfg.JWT.Secret,
+		PublicURL:   cfg.PublicURL,
+		SenderEmail: cfg.SMTP.SenderEmail,
+	})
 
-	app := fiber.New()
+	if cfg.Cassandra.MigrateOnStartup {
+		if err := schema.Migrate(ctx, session); err != nil {
+			slog.Error("Failed to migrate schema", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	expectedSchema, err := schema.Latest()
+	if err != nil {
+		slog.Error("Failed to load schema migrations", "error", err)
+		os.Exit(1)
+	}
+	var readiness health.Checker
+	readiness.Add("cassandra", health.CassandraCheck(session))
+	readiness.Add("schema", health.SchemaCheck(session, expectedSchema))
+	readiness.Add("signing_key", signingKeyCheck(tenants))
+	if cfg.SMTP.Host != "" {
+		readiness.Add("smtp", health.TCPCheck(cfg.SMTP.Addr()))
+	}
+
+	spec, err := openapi.Load(openapiDocument)
+	if err != nil {
+		slog.Error("Failed to load the OpenAPI document", "error", err)
+		os.Exit(1)
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: response.ErrorHandler})
+
+	// Probes are registered ahead of the middleware so they are neither logged nor traced
+	app.Get("/healthz", health.Liveness)
+	app.Get("/readyz", readiness.Readiness)
+
+	app.Use(tracing.Middleware())
+	app.Use(logging.Middleware(logger))
+	app.Use(metrics.Middleware())
+	// Every request belongs to a tenant, resolved by host or header
+	app.Use(tenants.Middleware())
+
+	// Requests of signed-in users are authenticated before their shape is validated
+	app.Use("/api-keys", caller.Middleware(apiKeys))
+	app.Use(spec.Middleware())
 
 	// Routes
 	app.Post("/login", login)
+	app.Post("/login/magic-link", requestMagicLink)
+	app.Post("/login/magic-link/callback", magicLinkCallback)
+	app.Post("/login/code/request", requestLoginCode)
+	app.Post("/login/code", loginWithCode)
+	app.Post("/login/oidc/:provider", startOIDCLogin)
+	app.Post("/login/oidc/:provider/callback", oidcCallback)
 	app.Post("/token/refresh", refreshToken)
 	app.Post("/logout", logout)
+	app.Post("/api-keys", createAPIKey)
+	app.Get("/api-keys", listAPIKeys)
+	app.Delete("/api-keys/:id", revokeAPIKey)
+	app.Get("/metrics", metrics.Handler())
+	app.Get("/openapi.json", spec.Handler)
 
-	log.Fatal(app.Listen(":3000"))
-}
+	// Deliver webhooks in the background
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		webhooks.Run(ctx)
+	}()
 
-func initCassandra() (*gocql.Session, error) {
-	cassandraHosts := strings.Split(os.Getenv("CASSANDRA_HOSTS"), ",")
-	cluster := gocql.NewCluster(cassandraHosts...)
-	cluster.Keyspace = os.Getenv("CASSANDRA_KEYSPACE")
-	cluster.Consistency = gocql.Quorum
-	return cluster.CreateSession()
+	// Serve until signalled, then drain requests and webhook deliveries before
+	// the deferred calls close the Cassandra session and flush traces
+	if err := server.Serve(ctx, app, cfg.HTTP.Addr(), cfg.HTTP.ShutdownTimeout, &workers); err != nil {
+		slog.Error("Server stopped", "error", err)
+	}
 }
@@ -12,6 +12,10 @@ type User struct {
 	Username string     `json:"username"`
 	Email    string     `json:"email"`
 	Password string     `json:"password"`
+	Locale   string     `json:"locale"`
+	// AuthSource is empty for local users, or the Source of the Authenticator
+	AuthSource string   `json:"auth_source"`
+	Roles      []string `json:"roles"`
 }
 
 // RefreshToken represents the refresh_tokens table schema
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/auth"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tracing"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/oauth2"
+)
+
+// Sign-in through an external provider takes two calls. The client asks
+// /login/oidc/:provider for an authorization URL and sends the user there;
+// the provider redirects back to the client, which passes the code and state
+// on to /login/oidc/:provider/callback in exchange for tokens. The client
+// must check that the state it gets back is the one it was given.
+
+// oidcClient makes the requests to the providers
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProvider is a configured provider. Its discovery document is fetched
+// on first use, so that a provider being down does not stop the service.
+type oidcProvider struct {
+	name   string
+	config OIDCProvider
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// newOIDCProviders returns the providers of the configuration by name
+func newOIDCProviders(providers map[string]OIDCProvider) map[string]*oidcProvider {
+	byName := make(map[string]*oidcProvider, len(providers))
+	for name, config := range providers {
+		byName[name] = &oidcProvider{name: name, config: config}
+	}
+	return byName
+}
+
+// discover returns the provider, fetching its discovery document if needed.
+// Failures are not cached and are retried by the next sign-in.
+func (p *oidcProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.provider == nil {
+		provider, err := oidc.NewProvider(oidc.ClientContext(ctx, oidcClient), p.config.Issuer())
+		if err != nil {
+			return nil, err
+		}
+		p.provider = provider
+	}
+	return p.provider, nil
+}
+
+// oauth2Config returns the OAuth 2.0 client settings for the provider. The
+// default redirect URL is at the public URL of the tenant in ctx.
+func (p *oidcProvider) oauth2Config(ctx context.Context, provider *oidc.Provider) *oauth2.Config {
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range p.config.Scopes {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(p.config.Scopes) == 0 {
+		scopes = append(scopes, "email", "profile")
+	}
+
+	redirectURL := p.config.RedirectURL
+	if redirectURL == "" {
+		redirectURL = tenant.FromContext(ctx).PublicURL + "/login/oidc/" + p.name + "/callback"
+	}
+
+	return &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}
+}
+
+// oidcClaims are the claims of an ID token used to find or create the local user
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// startOIDCLogin returns the URL at which the user signs in with a provider
+func startOIDCLogin(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	p, ok := oidcProviders[c.Params("provider")]
+	if !ok {
+		return response.New(response.CodeNotFound, "Unknown identity provider")
+	}
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return response.Wrap(response.CodeUnavailable, err, "Identity provider is unavailable")
+	}
+
+	state, err := auth.GenerateBase64RandomToken(43)
+	if err != nil {
+		return response.Internal(err, "Error starting sign-in")
+	}
+	nonce, err := auth.GenerateBase64RandomToken(43)
+	if err != nil {
+		return response.Internal(err, "Error starting sign-in")
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	err = session.Query(`INSERT INTO oidc_states (state, provider, tenant, nonce, code_verifier) VALUES (?, ?, ?, ?, ?) USING TTL ?`,
+		state, p.name, tenant.FromContext(ctx).ID, nonce, verifier, int(cfg.OIDC.StateTTL.Seconds())).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error starting sign-in")
+	}
+
+	url := p.oauth2Config(ctx, provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	return response.Success(c, fiber.StatusOK, "", fiber.Map{
+		"authorization_url": url,
+		"state":             state,
+	})
+}
+
+// oidcCallback completes a sign-in with a provider and issues tokens for the
+// linked local user, linking or creating one first if needed
+func oidcCallback(c *fiber.Ctx) error {
+	var data struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	ctx := c.UserContext()
+	if err := c.BodyParser(&data); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	p, ok := oidcProviders[c.Params("provider")]
+	if !ok {
+		return response.New(response.CodeNotFound, "Unknown identity provider")
+	}
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return response.Wrap(response.CodeUnavailable, err, "Identity provider is unavailable")
+	}
+
+	nonce, verifier, err := consumeOIDCState(ctx, data.State, p.name)
+	if err == gocql.ErrNotFound {
+		metrics.Outcome(metrics.OutcomeOIDCFailed)
+		return response.New(response.CodeTokenInvalid, "Invalid or expired sign-in")
+	}
+	if err != nil {
+		return response.Internal(err, "Error signing in")
+	}
+
+	// Exchange the code and check the ID token it comes with
+	claims, subject, err := p.exchange(ctx, provider, data.Code, verifier, nonce)
+	if err != nil {
+		logging.FromCtx(c).Warn("Sign-in at identity provider failed", "provider", p.name, "error", err)
+		metrics.Outcome(metrics.OutcomeOIDCFailed)
+		return response.New(response.CodeTokenInvalid, "Sign-in at the identity provider failed")
+	}
+
+	userID, err := resolveIdentity(c, p.name, subject, claims)
+	switch {
+	case errors.Is(err, errIdentityEmailTaken):
+		metrics.Outcome(metrics.OutcomeOIDCFailed)
+		return response.New(response.CodeEmailTaken, "An account with this email address already exists")
+	case errors.Is(err, errIdentityNoEmail):
+		metrics.Outcome(metrics.OutcomeOIDCFailed)
+		return response.New(response.CodeForbidden, "The identity provider did not share an email address")
+	case err != nil:
+		return response.Internal(err, "Error signing in")
+	}
+
+	if err := ensureActive(c, userID, "oidc"); err != nil {
+		return err
+	}
+
+	metrics.Outcome(metrics.OutcomeOIDCLogin)
+	event := audit.FromRequest(c, audit.LoginSucceeded, userID)
+	event.Details = map[string]string{"method": "oidc", "provider": p.name}
+	auditLog.Record(ctx, event)
+	return issueTokens(c, userID)
+}
+
+// consumeOIDCState deletes a sign-in in progress and returns its nonce and
+// PKCE verifier. Unknown, used and expired states, and states of another
+// provider or tenant, all yield gocql.ErrNotFound.
+func consumeOIDCState(ctx context.Context, state, provider string) (nonce, verifier string, err error) {
+	var stateProvider, stateTenant string
+	err = session.Query(`SELECT provider, tenant, nonce, code_verifier FROM oidc_states WHERE state = ?`, state).WithContext(ctx).
+		Scan(&stateProvider, &stateTenant, &nonce, &verifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	applied, err := session.Query(`DELETE FROM oidc_states WHERE state = ? IF EXISTS`, state).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return "", "", err
+	}
+	if !applied || stateProvider != provider || tenant.Stored(stateTenant) != tenant.FromContext(ctx).ID {
+		return "", "", gocql.ErrNotFound
+	}
+	return nonce, verifier, nil
+}
+
+// exchange redeems an authorization code and returns the verified claims and
+// subject of the ID token
+func (p *oidcProvider) exchange(ctx context.Context, provider *oidc.Provider, code, verifier, nonce string) (claims oidcClaims, subject string, err error) {
+	ctx, span := tracing.Start(ctx, "oidc.exchange")
+	defer func() { tracing.End(span, err) }()
+
+	ctx = oidc.ClientContext(ctx, oidcClient)
+	token, err := p.oauth2Config(ctx, provider).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return claims, "", err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return claims, "", errors.New("token response has no id_token")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.config.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return claims, "", err
+	}
+	if idToken.Nonce != nonce {
+		return claims, "", errors.New("id_token nonce does not match")
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return claims, "", err
+	}
+	return claims, idToken.Subject, nil
+}
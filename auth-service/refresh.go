@@ -1,63 +1,115 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"time"
 
 	"github.com/bdobrica/LLMDesignedApp/go-common/auth"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/userstatus"
 	"github.com/gocql/gocql"
 )
 
-// GenerateRefreshToken generates a new refresh token for the user
-func GenerateRefreshToken(userID gocql.UUID) (string, error) {
+// ErrRefreshTokenExpired is returned for refresh tokens past their expiry
+var ErrRefreshTokenExpired = errors.New("refresh token expired")
+
+// GenerateRefreshToken generates a new refresh token for the user, valid in
+// the tenant in ctx
+func GenerateRefreshToken(ctx context.Context, userID gocql.UUID) (string, error) {
 	refreshToken, err := auth.GenerateBase64RandomToken(32) // Use a strong random generator here
 	if err != nil {
-		log.Println("Error generating a random token")
+		slog.Error("Error generating a random token", "error", err)
 		return "", err
 	}
-	expiresAt := time.Now().Add(7 * 24 * time.Hour) // Refresh token valid for 7 days
+	// Cassandra removes the row on its own once the TTL derived from the lifetime runs out
+	expiresAt := time.Now().Add(cfg.JWT.RefreshTokenTTL)
 
-	err = session.Query(`INSERT INTO refresh_tokens ("token", user_id, expires_at) VALUES (?, ?, ?)`,
-		refreshToken, userID, expiresAt).Exec()
+	ttl := int(cfg.JWT.RefreshTokenTTL.Seconds())
+	err = session.Query(`INSERT INTO refresh_tokens_by_user (user_id, "token", expires_at) VALUES (?, ?, ?) USING TTL ?`,
+		userID, refreshToken, expiresAt, ttl).WithContext(ctx).Exec()
+	if err == nil {
+		err = session.Query(`INSERT INTO refresh_tokens ("token", user_id, tenant, expires_at) VALUES (?, ?, ?, ?) USING TTL ?`,
+			refreshToken, userID, tenant.FromContext(ctx).ID, expiresAt, ttl).WithContext(ctx).Exec()
+	}
 	if err != nil {
-		log.Println("Error inserting refresh token into the database")
+		slog.Error("Error inserting refresh token into the database", "error", err)
 		return "", err
 	}
 
 	return refreshToken, nil
 }
 
-// ValidateRefreshToken checks if the refresh token is valid
-func ValidateRefreshToken(token string) (gocql.UUID, error) {
+// ValidateRefreshToken checks if the refresh token is valid. Tokens of other
+// tenants than the one in ctx, and tokens of deleted users, yield
+// gocql.ErrNotFound. Tokens of accounts that are not active yield the
+// *response.Error of their status, see userstatus.Error.
+func ValidateRefreshToken(ctx context.Context, token string) (gocql.UUID, error) {
 	var userID gocql.UUID
+	var tenantID string
 	var expiresAt time.Time
 
-	err := session.Query(`SELECT user_id, expires_at FROM refresh_tokens WHERE "token" = ?`, token).
-		Scan(&userID, &expiresAt)
+	err := session.Query(`SELECT user_id, tenant, expires_at FROM refresh_tokens WHERE "token" = ?`, token).WithContext(ctx).
+		Scan(&userID, &tenantID, &expiresAt)
 	if err != nil {
-		log.Println("Error scanning refresh token from the database")
+		slog.Warn("Error scanning refresh token from the database", "error", err)
 		return gocql.UUID{}, err
 	}
+	if tenant.Stored(tenantID) != tenant.FromContext(ctx).ID {
+		return gocql.UUID{}, gocql.ErrNotFound
+	}
 
 	if time.Now().After(expiresAt) {
-		log.Println("Refresh token expired")
+		slog.Info("Refresh token expired", "user_id", userID)
 		// Revoke the token if it's expired
-		err = RevokeRefreshToken(token)
+		err = RevokeRefreshToken(ctx, userID, token)
 		if err != nil {
-			log.Println("Error revoking expired refresh token")
+			slog.Error("Error revoking expired refresh token", "error", err)
+		}
+		return gocql.UUID{}, ErrRefreshTokenExpired
+	}
+
+	// Deleting a user revokes the tokens listed for them, but not those
+	// issued before tokens were listed by user
+	status, err := userstatus.Load(ctx, session, userID)
+	if err == gocql.ErrNotFound {
+		if err := RevokeRefreshToken(ctx, userID, token); err != nil {
+			slog.Error("Error revoking refresh token of a deleted user", "error", err)
 		}
-		return gocql.UUID{}, fmt.Errorf("refresh token expired")
+		return gocql.UUID{}, gocql.ErrNotFound
+	}
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	// Suspending an account revokes its sessions; this catches the rest
+	if err := userstatus.Error(status); err != nil {
+		return gocql.UUID{}, err
 	}
 
 	return userID, nil
 }
 
-// RevokeRefreshToken deletes the token from the database
-func RevokeRefreshToken(token string) error {
-	err := session.Query(`DELETE FROM refresh_tokens WHERE "token" = ?`, token).Exec()
+// RefreshTokenOwner returns the user a refresh token was issued to, if it
+// was issued in the tenant in ctx
+func RefreshTokenOwner(ctx context.Context, token string) (gocql.UUID, error) {
+	var userID gocql.UUID
+	var tenantID string
+	err := session.Query(`SELECT user_id, tenant FROM refresh_tokens WHERE "token" = ?`, token).WithContext(ctx).Scan(&userID, &tenantID)
+	if err == nil && tenant.Stored(tenantID) != tenant.FromContext(ctx).ID {
+		err = gocql.ErrNotFound
+	}
+	return userID, err
+}
+
+// RevokeRefreshToken deletes the token of userID from the database
+func RevokeRefreshToken(ctx context.Context, userID gocql.UUID, token string) error {
+	err := session.Query(`DELETE FROM refresh_tokens WHERE "token" = ?`, token).WithContext(ctx).Exec()
+	if err == nil {
+		err = session.Query(`DELETE FROM refresh_tokens_by_user WHERE user_id = ? AND "token" = ?`, userID, token).WithContext(ctx).Exec()
+	}
 	if err != nil {
-		log.Println("Error deleting refresh token from the database")
+		slog.Error("Error deleting refresh token from the database", "error", err)
 		return err
 	}
 	return nil
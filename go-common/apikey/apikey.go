@@ -0,0 +1,255 @@
+// Package apikey issues and checks the personal API keys that scripts and CI
+// jobs use in place of short-lived access tokens. A key is the Prefix, 30
+// random base62 characters and a base62 CRC32 checksum of those, so that
+// secret scanners can recognise keys and tell them from random strings
+// without asking us. Only the SHA-256 hash of a key is stored.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Prefix starts every key
+const Prefix = "lda_"
+
+const (
+	// ScopeRead allows GET and HEAD requests
+	ScopeRead = "read"
+	// ScopeWrite allows every other request
+	ScopeWrite = "write"
+)
+
+const (
+	alphabet       = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	randomLength   = 30
+	checksumLength = 6
+	// hintLength is how much of the key is kept in the clear
+	hintLength = len(Prefix) + 4
+)
+
+var (
+	// ErrInvalidKey is returned for malformed, unknown, revoked and expired keys alike
+	ErrInvalidKey = errors.New("invalid or expired API key")
+	// ErrNotFound is returned when revoking a key the user does not have
+	ErrNotFound = errors.New("API key not found")
+)
+
+// Key describes an API key without the key itself
+type Key struct {
+	ID     gocql.UUID `json:"id"`
+	UserID gocql.UUID `json:"-"`
+	Tenant string     `json:"-"`
+	Name   string     `json:"name"`
+	Scopes []string   `json:"scopes"`
+	// Hint is the start of the key
+	Hint       string     `json:"hint"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// HasScope reports whether the key was granted scope
+func (k Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps the API keys of all users
+type Store struct {
+	Session *gocql.Session
+}
+
+// Create issues a key for userID of tenantID and returns it along with its
+// description. The key cannot be recovered later. A nil expiresAt creates a
+// key that is valid until revoked.
+func (s *Store) Create(ctx context.Context, tenantID string, userID gocql.UUID, name string, scopes []string, expiresAt *time.Time) (Key, string, error) {
+	secret, err := generate()
+	if err != nil {
+		return Key{}, "", err
+	}
+	key := Key{
+		ID:        gocql.TimeUUID(),
+		UserID:    userID,
+		Tenant:    tenantID,
+		Name:      name,
+		Scopes:    scopes,
+		Hint:      secret[:hintLength],
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	// A TTL of 0 keeps the rows until they are deleted
+	keyTTL := ttl(key.ExpiresAt)
+	keyHash := hash(secret)
+
+	err = s.Session.Query(`INSERT INTO api_keys_by_user (user_id, id, key_hash, hint, name, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+		key.UserID, key.ID, keyHash, key.Hint, key.Name, key.Scopes, key.CreatedAt, key.ExpiresAt, keyTTL).WithContext(ctx).Exec()
+	if err != nil {
+		return Key{}, "", err
+	}
+	err = s.Session.Query(`INSERT INTO api_keys (key_hash, id, user_id, tenant, name, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+		keyHash, key.ID, key.UserID, key.Tenant, key.Name, key.Scopes, key.CreatedAt, key.ExpiresAt, keyTTL).WithContext(ctx).Exec()
+	if err != nil {
+		return Key{}, "", err
+	}
+	return key, secret, nil
+}
+
+// List returns the keys of userID, newest first
+func (s *Store) List(ctx context.Context, userID gocql.UUID) ([]Key, error) {
+	iter := s.Session.Query(`SELECT id, key_hash, hint, name, scopes, created_at, expires_at, last_used_at FROM api_keys_by_user WHERE user_id = ?`,
+		userID).WithContext(ctx).Iter()
+	var keys []Key
+	for {
+		key := Key{UserID: userID}
+		var keyHash string
+		if !iter.Scan(&key.ID, &keyHash, &key.Hint, &key.Name, &key.Scopes, &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt) {
+			break
+		}
+		// Only last_used_at is left of a key that was used while being revoked
+		if keyHash == "" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, iter.Close()
+}
+
+// Revoke deletes the key id of userID
+func (s *Store) Revoke(ctx context.Context, userID, id gocql.UUID) error {
+	var keyHash string
+	err := s.Session.Query(`SELECT key_hash FROM api_keys_by_user WHERE user_id = ? AND id = ?`, userID, id).WithContext(ctx).Scan(&keyHash)
+	if err == gocql.ErrNotFound || (err == nil && keyHash == "") {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// The key stops working as soon as its hash is gone
+	if err := s.Session.Query(`DELETE FROM api_keys WHERE key_hash = ?`, keyHash).WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	return s.Session.Query(`DELETE FROM api_keys_by_user WHERE user_id = ? AND id = ?`, userID, id).WithContext(ctx).Exec()
+}
+
+// RevokeAll deletes every key of userID
+func (s *Store) RevokeAll(ctx context.Context, userID gocql.UUID) error {
+	var keyHash string
+	iter := s.Session.Query(`SELECT key_hash FROM api_keys_by_user WHERE user_id = ?`, userID).WithContext(ctx).Iter()
+	for iter.Scan(&keyHash) {
+		if keyHash == "" {
+			continue
+		}
+		if err := s.Session.Query(`DELETE FROM api_keys WHERE key_hash = ?`, keyHash).WithContext(ctx).Exec(); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return s.Session.Query(`DELETE FROM api_keys_by_user WHERE user_id = ?`, userID).WithContext(ctx).Exec()
+}
+
+// Authenticate returns the key described by secret and records its use.
+// Malformed keys are rejected without a query. The caller checks that the
+// key belongs to the tenant of the request.
+func (s *Store) Authenticate(ctx context.Context, secret string) (Key, error) {
+	if !Valid(secret) {
+		return Key{}, ErrInvalidKey
+	}
+	var key Key
+	err := s.Session.Query(`SELECT id, user_id, tenant, name, scopes, created_at, expires_at FROM api_keys WHERE key_hash = ?`, hash(secret)).WithContext(ctx).
+		Scan(&key.ID, &key.UserID, &key.Tenant, &key.Name, &key.Scopes, &key.CreatedAt, &key.ExpiresAt)
+	if err == gocql.ErrNotFound {
+		return Key{}, ErrInvalidKey
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	// The TTL may not have removed the row yet
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		return Key{}, ErrInvalidKey
+	}
+	key.Hint = secret[:hintLength]
+
+	// The use is written with the remaining lifetime, or it would outlive the key
+	now := time.Now()
+	key.LastUsedAt = &now
+	if err := s.Session.Query(`UPDATE api_keys_by_user USING TTL ? SET last_used_at = ? WHERE user_id = ? AND id = ?`,
+		ttl(key.ExpiresAt), now, key.UserID, key.ID).WithContext(ctx).Exec(); err != nil {
+		slog.Error("Error recording API key use", "key_id", key.ID, "error", err)
+	}
+	return key, nil
+}
+
+// Valid reports whether secret has the form of a key and a matching checksum
+func Valid(secret string) bool {
+	random, found := strings.CutPrefix(secret, Prefix)
+	if !found || len(random) != randomLength+checksumLength {
+		return false
+	}
+	for _, r := range random {
+		if !strings.ContainsRune(alphabet, r) {
+			return false
+		}
+	}
+	random, sum := random[:randomLength], random[randomLength:]
+	return checksum(random) == sum
+}
+
+// generate returns a new random key
+func generate() (string, error) {
+	var b strings.Builder
+	b.WriteString(Prefix)
+	base := big.NewInt(int64(len(alphabet)))
+	for i := 0; i < randomLength; i++ {
+		n, err := rand.Int(rand.Reader, base)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(alphabet[n.Int64()])
+	}
+	b.WriteString(checksum(b.String()[len(Prefix):]))
+	return b.String(), nil
+}
+
+// checksum encodes the CRC32 of random in base62, padded to checksumLength
+func checksum(random string) string {
+	sum := crc32.ChecksumIEEE([]byte(random))
+	encoded := make([]byte, checksumLength)
+	for i := checksumLength - 1; i >= 0; i-- {
+		encoded[i] = alphabet[sum%uint32(len(alphabet))]
+		sum /= uint32(len(alphabet))
+	}
+	return string(encoded)
+}
+
+// ttl returns the seconds left until expiresAt, or 0 for keys that do not expire
+func ttl(expiresAt *time.Time) int {
+	if expiresAt == nil {
+		return 0
+	}
+	return max(int(time.Until(*expiresAt).Seconds()), 1)
+}
+
+// hash is what is stored in place of a key
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
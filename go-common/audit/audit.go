@@ -0,0 +1,235 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// EventType names a security relevant action
+type EventType string
+
+const (
+	LoginSucceeded    EventType = "login_succeeded"
+	LoginFailed       EventType = "login_failed"
+	TokenRefreshed    EventType = "token_refreshed"
+	LoggedOut         EventType = "logged_out"
+	UserRegistered    EventType = "user_registered"
+	EmailVerified     EventType = "email_verified"
+	RecoveryRequested EventType = "recovery_requested"
+	PasswordReset     EventType = "password_reset"
+	MagicLinkSent     EventType = "magic_link_sent"
+	EmailCodeSent     EventType = "email_code_sent"
+	IdentityLinked    EventType = "identity_linked"
+	APIKeyCreated     EventType = "api_key_created"
+	APIKeyRevoked     EventType = "api_key_revoked"
+	OrgCreated        EventType = "org_created"
+	OrgDeleted        EventType = "org_deleted"
+	OrgInviteSent     EventType = "org_invitation_sent"
+	OrgJoined         EventType = "org_joined"
+	OrgRoleChanged    EventType = "org_role_changed"
+	OrgMemberRemoved  EventType = "org_member_removed"
+	DeletionRequested EventType = "account_deletion_requested"
+	DeletionCancelled EventType = "account_deletion_cancelled"
+	AccountDeleted    EventType = "account_deleted"
+	ExportRequested   EventType = "data_export_requested"
+	StatusChanged     EventType = "account_status_changed"
+)
+
+// Actors that are not users
+const (
+	ActorAdmin  = "admin"
+	ActorSystem = "system"
+)
+
+// MaxRange bounds the time range of a single Query
+const MaxRange = 31 * 24 * time.Hour
+
+// Event is one entry of the audit log
+type Event struct {
+	ID        gocql.UUID        `json:"id"`
+	Type      EventType         `json:"type"`
+	UserID    gocql.UUID        `json:"user_id"`
+	Actor     string            `json:"actor"`
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+// Recorder writes and reads the audit_events table
+type Recorder struct {
+	Session *gocql.Session
+}
+
+// FromRequest starts an event for userID acting on their own behalf, taking
+// the client IP and user agent from the request
+func FromRequest(c *fiber.Ctx, eventType EventType, userID gocql.UUID) Event {
+	return Event{
+		Type:      eventType,
+		UserID:    userID,
+		Actor:     userID.String(),
+		IP:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+	}
+}
+
+// Record stores e. Auditing must not break the action being audited, so
+// failures are logged rather than returned.
+func (r *Recorder) Record(ctx context.Context, e Event) {
+	if e.ID == (gocql.UUID{}) {
+		e.ID = gocql.TimeUUID()
+	}
+	day := e.ID.Time().UTC()
+	err := r.Session.Query(`INSERT INTO audit_events (user_id, day, event_id, type, actor, ip, user_agent, details)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.UserID, day, e.ID, string(e.Type), e.Actor, e.IP, e.UserAgent, e.Details).WithContext(ctx).Exec()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording audit event", "type", e.Type, "user_id", e.UserID, "error", err)
+		return
+	}
+	if ActedForOther(e.UserID, e.Actor) {
+		err = r.Session.Query(`INSERT INTO audit_events_by_actor (actor, event_id, user_id) VALUES (?, ?, ?)`, e.Actor, e.ID, e.UserID).WithContext(ctx).Exec()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error indexing audit event", "type", e.Type, "actor", e.Actor, "error", err)
+		}
+	}
+}
+
+// ActedForOther reports whether actor is a user other than userID; such
+// events are indexed in audit_events_by_actor
+func ActedForOther(userID gocql.UUID, actor string) bool {
+	if actor == ActorAdmin || actor == ActorSystem || actor == userID.String() {
+		return false
+	}
+	_, err := gocql.ParseUUID(actor)
+	return err == nil
+}
+
+// Query returns the events of userID between from and to, newest first,
+// optionally restricted to the given types
+func (r *Recorder) Query(ctx context.Context, userID gocql.UUID, from, to time.Time, types ...EventType) ([]Event, error) {
+	if to.Before(from) {
+		return nil, fmt.Errorf("range ends before it starts")
+	}
+	if to.Sub(from) > MaxRange {
+		return nil, fmt.Errorf("range is longer than %s", MaxRange)
+	}
+	wanted := make(map[EventType]bool, len(types))
+	for _, t := range types {
+		wanted[t] = true
+	}
+
+	var events []Event
+	lastDay := truncateDay(to)
+	for day := lastDay; !day.Before(truncateDay(from)); day = day.AddDate(0, 0, -1) {
+		iter := r.Session.Query(`SELECT event_id, type, actor, ip, user_agent, details FROM audit_events
+            WHERE user_id = ? AND day = ? AND event_id >= minTimeuuid(?) AND event_id <= maxTimeuuid(?)`,
+			userID, day, from, to).WithContext(ctx).Iter()
+
+		var e Event
+		var eventType string
+		for iter.Scan(&e.ID, &eventType, &e.Actor, &e.IP, &e.UserAgent, &e.Details) {
+			e.Type = EventType(eventType)
+			if len(wanted) > 0 && !wanted[e.Type] {
+				continue
+			}
+			e.UserID = userID
+			e.Time = e.ID.Time()
+			events = append(events, e)
+			e = Event{}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// History returns every event of userID since the given time, newest first
+func (r *Recorder) History(ctx context.Context, userID gocql.UUID, since time.Time) ([]Event, error) {
+	var events []Event
+	for to := time.Now(); !to.Before(since); {
+		from := to.Add(-MaxRange)
+		if from.Before(since) {
+			from = since
+		}
+		page, err := r.Query(ctx, userID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, page...)
+		to = from.Add(-time.Millisecond)
+	}
+	return events, nil
+}
+
+// Pseudonymize moves the events of userID since the given time to the
+// partitions of pseudonym. What could identify the user is dropped on the
+// way: the IP, the user agent, the details and the actor where the user
+// acted on their own behalf. Types and times are kept. Events the user
+// recorded in the partitions of others get pseudonym as their actor and lose
+// the IP and user agent.
+func (r *Recorder) Pseudonymize(ctx context.Context, userID, pseudonym gocql.UUID, since time.Time) error {
+	self := userID.String()
+	lastDay := truncateDay(time.Now())
+	for day := truncateDay(since); !day.After(lastDay); day = day.AddDate(0, 0, 1) {
+		var (
+			eventID   gocql.UUID
+			eventType string
+			actor     string
+		)
+		iter := r.Session.Query(`SELECT event_id, type, actor FROM audit_events WHERE user_id = ? AND day = ?`, userID, day).WithContext(ctx).Iter()
+		for iter.Scan(&eventID, &eventType, &actor) {
+			other := ActedForOther(userID, actor)
+			if actor == self {
+				actor = pseudonym.String()
+			}
+			err := r.Session.Query(`INSERT INTO audit_events (user_id, day, event_id, type, actor) VALUES (?, ?, ?, ?, ?)`,
+				pseudonym, day, eventID, eventType, actor).WithContext(ctx).Exec()
+			if err == nil && other {
+				// The index of the actor follows the event, unless the actor
+				// was deleted and is no longer indexed
+				_, err = r.Session.Query(`UPDATE audit_events_by_actor SET user_id = ? WHERE actor = ? AND event_id = ? IF EXISTS`,
+					pseudonym, actor, eventID).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+			}
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		if err := r.Session.Query(`DELETE FROM audit_events WHERE user_id = ? AND day = ?`, userID, day).WithContext(ctx).Exec(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		eventID gocql.UUID
+		owner   gocql.UUID
+	)
+	iter := r.Session.Query(`SELECT event_id, user_id FROM audit_events_by_actor WHERE actor = ?`, self).WithContext(ctx).Iter()
+	for iter.Scan(&eventID, &owner) {
+		err := r.Session.Query(`UPDATE audit_events SET actor = ?, ip = null, user_agent = null WHERE user_id = ? AND day = ? AND event_id = ?`,
+			pseudonym.String(), owner, truncateDay(eventID.Time()), eventID).WithContext(ctx).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return r.Session.Query(`DELETE FROM audit_events_by_actor WHERE actor = ?`, self).WithContext(ctx).Exec()
+}
+
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
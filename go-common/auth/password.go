@@ -1,15 +1,22 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"golang.org/x/crypto/bcrypt"
+)
 
 // HashPassword hashes a plaintext password
 func HashPassword(password string) (string, error) {
+	defer metrics.ObserveSince(metrics.PasswordHashDuration, time.Now(), "hash")
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
 	return string(bytes), err
 }
 
 // CheckPasswordHash compares the plaintext password with the hashed password
 func CheckPasswordHash(password, hash string) bool {
+	defer metrics.ObserveSince(metrics.PasswordHashDuration, time.Now(), "compare")
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
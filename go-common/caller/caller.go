@@ -0,0 +1,114 @@
+// Package caller authenticates the user behind a request by the bearer
+// token in its Authorization header, which is either a JWT access token
+// issued by auth-service or a personal API key. Both must belong to the
+// tenant of the request.
+package caller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/apikey"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/userstatus"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const callerKey = "caller"
+
+// Caller is the authenticated user of a request
+type Caller struct {
+	UserID gocql.UUID
+	// Key is the API key the request was made with, or nil for an access token
+	Key *apikey.Key
+}
+
+// Middleware only lets requests through that carry an access token of
+// their tenant or an API key from keys, and stores their Caller for From. It
+// must run after tenant.Middleware. API keys need the read scope for GET and
+// HEAD requests and the write scope for any other, and only work for active
+// accounts.
+func Middleware(keys *apikey.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		t := tenant.FromContext(c.UserContext())
+		if t == nil {
+			return response.Internal(errors.New("request has no tenant"), "Error authenticating request")
+		}
+		token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !found || token == "" {
+			return response.New(response.CodeUnauthorized, "Unauthorized")
+		}
+
+		if !strings.HasPrefix(token, apikey.Prefix) {
+			userID, err := parseAccessToken(t, token)
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				return response.New(response.CodeTokenExpired, "Access token expired")
+			}
+			if err != nil {
+				return response.New(response.CodeTokenInvalid, "Invalid access token")
+			}
+			c.Locals(callerKey, Caller{UserID: userID})
+			return c.Next()
+		}
+
+		key, err := keys.Authenticate(c.UserContext(), token)
+		if err == nil && tenant.Stored(key.Tenant) != t.ID {
+			err = apikey.ErrInvalidKey
+		}
+		if errors.Is(err, apikey.ErrInvalidKey) {
+			return response.New(response.CodeTokenInvalid, "Invalid or expired API key")
+		}
+		if err != nil {
+			return response.Internal(err, "Error authenticating request")
+		}
+		scope := apikey.ScopeWrite
+		if c.Method() == http.MethodGet || c.Method() == http.MethodHead {
+			scope = apikey.ScopeRead
+		}
+		if !key.HasScope(scope) {
+			return response.New(response.CodeForbidden, "API key does not have the required scope")
+		}
+		// Sessions are revoked when an account is suspended, and access
+		// tokens expire soon after, but keys live on
+		status, err := userstatus.Load(c.UserContext(), keys.Session, key.UserID)
+		if err == gocql.ErrNotFound {
+			return response.New(response.CodeTokenInvalid, "Invalid or expired API key")
+		}
+		if err != nil {
+			return response.Internal(err, "Error authenticating request")
+		}
+		if err := userstatus.Error(status); err != nil {
+			return err
+		}
+		c.Locals(callerKey, Caller{UserID: key.UserID, Key: &key})
+		return c.Next()
+	}
+}
+
+// From returns the caller stored by Middleware; the zero Caller outside of
+// routes it guards
+func From(c *fiber.Ctx) Caller {
+	caller, _ := c.Locals(callerKey).(Caller)
+	return caller
+}
+
+// parseAccessToken validates a JWT access token issued for t and returns its user
+func parseAccessToken(t *tenant.Tenant, token string) (gocql.UUID, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired(), jwt.WithIssuer(t.Issuer))
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(t.JWTSecret), nil
+	})
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		return gocql.UUID{}, errors.New("access token has no user_id")
+	}
+	return gocql.ParseUUID(userID)
+}
@@ -0,0 +1,49 @@
+package cassandra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Backoff bounds the exponential backoff used by Connect
+type Backoff struct {
+	Initial time.Duration // first wait (default: 500ms)
+	Max     time.Duration // longest single wait (default: 30s)
+	Total   time.Duration // give up once this much time has passed (default: 2m)
+}
+
+// Connect creates a session, retrying with exponential backoff while the
+// cluster is unreachable, e.g. while Cassandra is still starting up
+func Connect(ctx context.Context, cluster *gocql.ClusterConfig, backoff Backoff) (*gocql.Session, error) {
+	if backoff.Initial <= 0 {
+		backoff.Initial = 500 * time.Millisecond
+	}
+	if backoff.Max <= 0 {
+		backoff.Max = 30 * time.Second
+	}
+	if backoff.Total <= 0 {
+		backoff.Total = 2 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, backoff.Total)
+	defer cancel()
+
+	wait := backoff.Initial
+	for attempt := 1; ; attempt++ {
+		session, err := cluster.CreateSession()
+		if err == nil {
+			return session, nil
+		}
+
+		slog.Warn("Cassandra is not reachable yet", "attempt", attempt, "retry_in", wait.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, backoff.Max)
+	}
+}
@@ -0,0 +1,42 @@
+package cassandra
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+// QueryObservers passes every observed query to each of its observers
+type QueryObservers []gocql.QueryObserver
+
+func (o QueryObservers) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	for _, observer := range o {
+		observer.ObserveQuery(ctx, q)
+	}
+}
+
+// BatchObservers passes every observed batch to each of its observers
+type BatchObservers []gocql.BatchObserver
+
+func (o BatchObservers) ObserveBatch(ctx context.Context, b gocql.ObservedBatch) {
+	for _, observer := range o {
+		observer.ObserveBatch(ctx, b)
+	}
+}
+
+var tablePattern = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE|TABLE|EXISTS|ON)\s+([A-Za-z_][A-Za-z0-9_.]*)`)
+
+// DescribeStatement extracts the CQL verb and the table a statement targets
+func DescribeStatement(stmt string) (operation, table string) {
+	fields := strings.Fields(stmt)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	operation = strings.ToUpper(fields[0])
+	if match := tablePattern.FindStringSubmatch(stmt); match != nil {
+		table = match[1]
+	}
+	return operation, table
+}
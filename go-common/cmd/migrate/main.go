@@ -0,0 +1,74 @@
+// Command migrate applies the CQL migrations in go-common/schema to the
+// keyspace named by CASSANDRA_KEYSPACE, configured like the services (see
+// config.Load).
+//
+// Usage:
+//
+//	migrate up      apply all pending migrations
+//	migrate status  list applied and pending migrations
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+	"github.com/bdobrica/LLMDesignedApp/go-common/migrate"
+	"github.com/bdobrica/LLMDesignedApp/go-common/schema"
+)
+
+func main() {
+	command := "up"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	migrations, err := schema.Migrations()
+	if err != nil {
+		log.Fatal("Failed to load migrations:", err)
+	}
+
+	cfg := struct {
+		Cassandra config.Cassandra `yaml:"cassandra"`
+	}{Cassandra: config.DefaultCassandra()}
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal("Invalid configuration:\n", err)
+	}
+
+	session, err := cfg.Cassandra.NewCluster().CreateSession()
+	if err != nil {
+		log.Fatal("Failed to connect to Cassandra:", err)
+	}
+	defer session.Close()
+
+	runner := &migrate.Runner{Session: session, Migrations: migrations}
+
+	switch command {
+	case "up":
+		ran, err := runner.Up(context.Background())
+		if err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		fmt.Printf("Applied %d migration(s), schema is at version %d\n", len(ran), migrate.Latest(migrations))
+	case "status":
+		applied, err := runner.Applied()
+		if err != nil {
+			log.Fatal("Failed to read applied migrations:", err)
+		}
+		done := make(map[int]bool, len(applied))
+		for _, m := range applied {
+			done[m.Version] = true
+			fmt.Printf("applied  %04d_%s  %s\n", m.Version, m.Name, m.AppliedAt.Format("2006-01-02 15:04:05"))
+		}
+		for _, m := range migrations {
+			if !done[m.Version] {
+				fmt.Printf("pending  %04d_%s\n", m.Version, m.Name)
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [up|status]\n", os.Args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Validator is implemented by configuration sections that check their own values
+type Validator interface {
+	Validate() error
+}
+
+// Load fills cfg, a pointer to a struct pre-populated with defaults. Values are
+// applied in order of increasing precedence:
+//
+//  1. the YAML file named by the CONFIG_FILE environment variable, if set
+//  2. the environment variable named by each field's `env` tag
+//  3. the file named by <env>_FILE, for secrets mounted from files
+//
+// Fields tagged `required:"true"` must end up non-zero, and every section
+// implementing Validator is validated. All problems are reported together.
+func Load(cfg interface{}) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: Load needs a pointer to a struct, got %T", cfg)
+	}
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return fmt.Errorf("config: parsing %s: %w", path, err)
+		}
+	}
+
+	var errs []error
+	loadEnv(v.Elem(), &errs)
+	if len(errs) == 0 {
+		validate(v.Elem(), &errs)
+	}
+	return errors.Join(errs...)
+}
+
+func loadEnv(v reflect.Value, errs *[]error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Tag.Get("env")
+		if name == "" {
+			if value.Kind() == reflect.Struct {
+				loadEnv(value, errs)
+			}
+			continue
+		}
+
+		raw, ok, err := lookup(name)
+		if err != nil {
+			*errs = append(*errs, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := set(value, raw); err != nil {
+			*errs = append(*errs, fmt.Errorf("config: %s: %w", name, err))
+		}
+	}
+}
+
+// lookup returns the value of name, or the trimmed content of the file named
+// by name_FILE. Empty variables count as unset.
+func lookup(name string) (string, bool, error) {
+	value := os.Getenv(name)
+	path := os.Getenv(name + "_FILE")
+	switch {
+	case value != "" && path != "":
+		return "", false, fmt.Errorf("config: both %s and %s_FILE are set", name, name)
+	case path != "":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("config: %s_FILE: %w", name, err)
+		}
+		return strings.TrimSpace(string(data)), true, nil
+	case value != "":
+		return value, true, nil
+	}
+	return "", false, nil
+}
+
+func set(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func validate(v reflect.Value, errs *[]error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			*errs = append(*errs, fmt.Errorf("config: %s is required", describe(field)))
+		}
+		if value.Kind() == reflect.Struct {
+			validate(value, errs)
+		}
+	}
+
+	if validator, ok := v.Addr().Interface().(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			*errs = append(*errs, fmt.Errorf("config: %w", err))
+		}
+	}
+}
+
+// describe names a field by its environment variable, falling back to its YAML key
+func describe(field reflect.StructField) string {
+	if name := field.Tag.Get("env"); name != "" {
+		return name
+	}
+	if name, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); name != "" {
+		return name
+	}
+	return field.Name
+}
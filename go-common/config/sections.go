@@ -0,0 +1,259 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// HTTP configures the listener of a service
+type HTTP struct {
+	Port int `yaml:"port" env:"HTTP_PORT"`
+	// ShutdownTimeout bounds how long in-flight requests and background
+	// workers get to finish after SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// Addr returns the address to pass to Listen
+func (h HTTP) Addr() string {
+	return ":" + strconv.Itoa(h.Port)
+}
+
+func (h HTTP) Validate() error {
+	if h.Port < 1 || h.Port > 65535 {
+		return fmt.Errorf("HTTP_PORT must be between 1 and 65535, got %d", h.Port)
+	}
+	return nil
+}
+
+// Cassandra configures the connection to the cluster
+type Cassandra struct {
+	Hosts            []string `yaml:"hosts" env:"CASSANDRA_HOSTS" required:"true"`
+	Keyspace         string   `yaml:"keyspace" env:"CASSANDRA_KEYSPACE" required:"true"`
+	Consistency      string   `yaml:"consistency" env:"CASSANDRA_CONSISTENCY"`
+	MigrateOnStartup bool     `yaml:"migrate_on_startup" env:"MIGRATE_ON_STARTUP"`
+	// ConnectTimeout is how long to keep retrying the initial connection
+	ConnectTimeout time.Duration `yaml:"connect_timeout" env:"CASSANDRA_CONNECT_TIMEOUT"`
+}
+
+// DefaultCassandra returns the settings used by docker-compose
+func DefaultCassandra() Cassandra {
+	return Cassandra{
+		Hosts:          []string{"localhost"},
+		Keyspace:       "user_management",
+		Consistency:    "QUORUM",
+		ConnectTimeout: 2 * time.Minute,
+	}
+}
+
+func (c Cassandra) Validate() error {
+	if _, err := gocql.ParseConsistencyWrapper(c.Consistency); err != nil {
+		return fmt.Errorf("CASSANDRA_CONSISTENCY: %w", err)
+	}
+	return nil
+}
+
+// NewCluster returns a gocql cluster configuration for these settings
+func (c Cassandra) NewCluster() *gocql.ClusterConfig {
+	cluster := gocql.NewCluster(c.Hosts...)
+	cluster.Keyspace = c.Keyspace
+	cluster.Consistency, _ = gocql.ParseConsistencyWrapper(c.Consistency)
+	return cluster
+}
+
+// Log configures the service logger
+type Log struct {
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+}
+
+func (l Log) Validate() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	return nil
+}
+
+// Tracing configures the OpenTelemetry trace exporter
+type Tracing struct {
+	// Exporter is "none", "otlp" or "stdout"
+	Exporter string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+	// Endpoint is the OTLP/HTTP collector URL, e.g. http://otel-collector:4318
+	Endpoint string `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	// File receives spans from the stdout exporter instead of stdout when set
+	File string `yaml:"file" env:"OTEL_TRACES_FILE"`
+}
+
+func (t Tracing) Validate() error {
+	switch t.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if t.Endpoint == "" {
+			return fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT is required when OTEL_TRACES_EXPORTER is otlp")
+		}
+	default:
+		return fmt.Errorf("OTEL_TRACES_EXPORTER must be none, otlp or stdout, got %q", t.Exporter)
+	}
+	return nil
+}
+
+// SMTP configures outgoing mail. Mail is only sent when Host is set.
+type SMTP struct {
+	Host        string `yaml:"host" env:"SMTP_HOST"`
+	Port        int    `yaml:"port" env:"SMTP_PORT"`
+	Username    string `yaml:"username" env:"SMTP_USERNAME"`
+	Password    string `yaml:"password" env:"SMTP_PASSWORD"`
+	SenderEmail string `yaml:"sender_email" env:"SMTP_SENDER_EMAIL"`
+}
+
+// DefaultSMTP returns the settings used when nothing is configured
+func DefaultSMTP() SMTP {
+	return SMTP{Port: 587}
+}
+
+func (s SMTP) Validate() error {
+	if s.Host != "" && s.SenderEmail == "" {
+		return fmt.Errorf("SMTP_SENDER_EMAIL is required when SMTP_HOST is set")
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		return fmt.Errorf("SMTP_PORT must be between 1 and 65535, got %d", s.Port)
+	}
+	return nil
+}
+
+// Addr returns the host:port of the SMTP server
+func (s SMTP) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// EmailCodes configures the one-time numeric codes sent by email
+type EmailCodes struct {
+	// Secret keys the hashes of stored codes, which could otherwise be
+	// reversed by trying all million codes
+	Secret string        `yaml:"secret" env:"EMAIL_CODE_SECRET" required:"true"`
+	TTL    time.Duration `yaml:"ttl" env:"EMAIL_CODE_TTL"`
+	// MaxAttempts is how many wrong guesses a code survives
+	MaxAttempts int `yaml:"max_attempts" env:"EMAIL_CODE_MAX_ATTEMPTS"`
+	// At most RequestLimit codes are sent to an address per RequestWindow
+	RequestLimit  int           `yaml:"request_limit" env:"EMAIL_CODE_REQUEST_LIMIT"`
+	RequestWindow time.Duration `yaml:"request_window" env:"EMAIL_CODE_REQUEST_WINDOW"`
+}
+
+// DefaultEmailCodes keeps codes short-lived, as six digits are easy to guess
+func DefaultEmailCodes() EmailCodes {
+	return EmailCodes{
+		TTL:           10 * time.Minute,
+		MaxAttempts:   5,
+		RequestLimit:  5,
+		RequestWindow: time.Hour,
+	}
+}
+
+func (e EmailCodes) Validate() error {
+	if e.TTL < time.Second || e.RequestWindow < time.Second {
+		return fmt.Errorf("EMAIL_CODE_TTL and EMAIL_CODE_REQUEST_WINDOW must be at least a second")
+	}
+	if e.MaxAttempts < 1 || e.RequestLimit < 1 {
+		return fmt.Errorf("EMAIL_CODE_MAX_ATTEMPTS and EMAIL_CODE_REQUEST_LIMIT must be at least 1")
+	}
+	return nil
+}
+
+// Webhooks configures the delivery of outbound webhooks
+type Webhooks struct {
+	// Timeout bounds a single delivery attempt
+	Timeout time.Duration `yaml:"timeout" env:"WEBHOOK_TIMEOUT"`
+	// MaxAttempts is how many times a delivery is tried before giving up
+	MaxAttempts int `yaml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+	// RetryBackoff is the wait before the first retry, doubled after each attempt
+	RetryBackoff time.Duration `yaml:"retry_backoff" env:"WEBHOOK_RETRY_BACKOFF"`
+	// QueueSize is how many events may wait for delivery before new ones are dropped
+	QueueSize int `yaml:"queue_size" env:"WEBHOOK_QUEUE_SIZE"`
+}
+
+// DefaultWebhooks retries for roughly an hour before giving up
+func DefaultWebhooks() Webhooks {
+	return Webhooks{
+		Timeout:      10 * time.Second,
+		MaxAttempts:  8,
+		RetryBackoff: 30 * time.Second,
+		QueueSize:    1000,
+	}
+}
+
+func (w Webhooks) Validate() error {
+	if w.Timeout <= 0 || w.RetryBackoff <= 0 {
+		return fmt.Errorf("WEBHOOK_TIMEOUT and WEBHOOK_RETRY_BACKOFF must be positive")
+	}
+	if w.MaxAttempts < 1 {
+		return fmt.Errorf("WEBHOOK_MAX_ATTEMPTS must be at least 1, got %d", w.MaxAttempts)
+	}
+	if w.QueueSize < 1 {
+		return fmt.Errorf("WEBHOOK_QUEUE_SIZE must be at least 1, got %d", w.QueueSize)
+	}
+	return nil
+}
+
+// Tenancy configures the customer apps sharing a deployment. Requests are
+// assigned to a tenant by their Host, then by the Header, and otherwise to
+// the default tenant, which owns all data from before tenants existed.
+// Tenants can only be set in the configuration file.
+type Tenancy struct {
+	// Header names the request header that may carry a tenant ID
+	Header string `yaml:"header" env:"TENANT_HEADER"`
+	// Tenants are keyed by tenant ID. The default tenant exists whether or
+	// not it is listed; listing it overrides its settings.
+	Tenants map[string]Tenant `yaml:"tenants"`
+}
+
+// Tenant holds the settings of one tenant. Settings left empty fall back to
+// those of the service.
+type Tenant struct {
+	// Hosts are the Host headers that select the tenant
+	Hosts []string `yaml:"hosts"`
+	// Issuer is the iss claim of the tenant's access tokens, by default its ID
+	Issuer string `yaml:"issuer"`
+	// JWTSecret signs the tenant's access tokens
+	JWTSecret string `yaml:"jwt_secret"`
+	// PublicURL is the base URL used in links sent to the tenant's users
+	PublicURL string `yaml:"public_url"`
+	// SenderEmail is the From address of the tenant's emails
+	SenderEmail string `yaml:"sender_email"`
+	// PasswordMinLength is the shortest password the tenant's users may set
+	PasswordMinLength int `yaml:"password_min_length"`
+}
+
+// DefaultTenancy returns the settings of a deployment without tenants
+func DefaultTenancy() Tenancy {
+	return Tenancy{Header: "X-Tenant-ID"}
+}
+
+func (t Tenancy) Validate() error {
+	hosts := make(map[string]string)
+	for id, tenant := range t.Tenants {
+		if !tenantIDPattern.MatchString(id) {
+			return fmt.Errorf("tenant %q: IDs must be 1 to 32 lowercase letters, digits and dashes", id)
+		}
+		// Passwords of more than 72 bytes cannot be hashed
+		if tenant.PasswordMinLength != 0 && (tenant.PasswordMinLength < 8 || tenant.PasswordMinLength > 72) {
+			return fmt.Errorf("tenant %q: password_min_length must be between 8 and 72, got %d", id, tenant.PasswordMinLength)
+		}
+		for _, host := range tenant.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := hosts[host]; ok {
+				return fmt.Errorf("tenant %q: host %s already belongs to tenant %q", id, host, other)
+			}
+			hosts[host] = id
+		}
+	}
+	return nil
+}
+
+// tenantIDPattern keeps tenant IDs safe to use in keys, headers and claims
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
@@ -0,0 +1,157 @@
+// Package emailcode issues and checks the six-digit codes that native apps
+// use instead of links for email verification, password reset and
+// passwordless login
+package emailcode
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"math/big"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/gocql/gocql"
+	"golang.org/x/text/language"
+)
+
+// Purpose keeps a code issued for one flow from being used in another
+type Purpose string
+
+const (
+	VerifyEmail   Purpose = "verify_email"
+	ResetPassword Purpose = "reset_password"
+	Login         Purpose = "login"
+)
+
+var (
+	// ErrInvalidCode is returned for wrong, used and expired codes alike
+	ErrInvalidCode = errors.New("invalid or expired code")
+	// ErrTooManyAttempts is returned once a code was guessed wrong too often.
+	// The code is discarded and a new one has to be requested.
+	ErrTooManyAttempts = errors.New("too many attempts")
+)
+
+// Store keeps one code per tenant, purpose and address. Addresses are
+// expected in the form returned by identity.EmailKey.
+type Store struct {
+	Session *gocql.Session
+	Config  config.EmailCodes
+}
+
+// Issue creates a code for userID, replacing any code previously issued for
+// the same purpose and address, and returns it
+func (s *Store) Issue(ctx context.Context, tenantID string, purpose Purpose, email string, userID gocql.UUID) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	err = s.Session.Query(`INSERT INTO email_codes (tenant, purpose, email, code_hash, user_id, attempts, expires_at) VALUES (?, ?, ?, ?, ?, 0, ?) USING TTL ?`,
+		tenantID, string(purpose), email, s.hash(purpose, email, code), userID, time.Now().Add(s.Config.TTL), int(s.Config.TTL.Seconds())).
+		WithContext(ctx).Exec()
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Check consumes the code for purpose and address and returns the user it
+// was issued to. Every guess is counted before it is compared, with a
+// lightweight transaction, so concurrent guesses cannot exceed MaxAttempts.
+func (s *Store) Check(ctx context.Context, tenantID string, purpose Purpose, email, code string) (gocql.UUID, error) {
+	var (
+		codeHash  string
+		userID    gocql.UUID
+		attempts  int
+		expiresAt time.Time
+	)
+	for {
+		err := s.Session.Query(`SELECT code_hash, user_id, attempts, expires_at FROM email_codes WHERE tenant = ? AND purpose = ? AND email = ?`,
+			tenantID, string(purpose), email).WithContext(ctx).Scan(&codeHash, &userID, &attempts, &expiresAt)
+		if err == gocql.ErrNotFound {
+			return gocql.UUID{}, ErrInvalidCode
+		}
+		if err != nil {
+			return gocql.UUID{}, err
+		}
+		remaining := time.Until(expiresAt)
+		if remaining < time.Second {
+			return gocql.UUID{}, ErrInvalidCode
+		}
+		if attempts >= s.Config.MaxAttempts {
+			s.discard(ctx, tenantID, purpose, email)
+			return gocql.UUID{}, ErrTooManyAttempts
+		}
+
+		// The TTL is renewed with the remaining lifetime, or the counter would outlive the code
+		applied, err := s.Session.Query(`UPDATE email_codes USING TTL ? SET attempts = ? WHERE tenant = ? AND purpose = ? AND email = ? IF attempts = ?`,
+			int(remaining.Seconds()), attempts+1, tenantID, string(purpose), email, attempts).WithContext(ctx).
+			MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			return gocql.UUID{}, err
+		}
+		if applied {
+			attempts++
+			break
+		}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(s.hash(purpose, email, code)), []byte(codeHash)) != 1 {
+		return gocql.UUID{}, ErrInvalidCode
+	}
+
+	// Only the request that deletes the code may use it
+	applied, err := s.Session.Query(`DELETE FROM email_codes WHERE tenant = ? AND purpose = ? AND email = ? IF attempts = ?`,
+		tenantID, string(purpose), email, attempts).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	if !applied {
+		return gocql.UUID{}, ErrInvalidCode
+	}
+	return userID, nil
+}
+
+// subjects gives the email subject for each purpose
+var subjects = map[Purpose]string{
+	VerifyEmail:   "Your verification code",
+	ResetPassword: "Your password reset code",
+	Login:         "Your sign-in code",
+}
+
+// Message returns the subject and HTML body of the email carrying code, in
+// the language tag
+func (s *Store) Message(tag language.Tag, purpose Purpose, code string) (subject, body string) {
+	subject = i18n.Translate(tag, subjects[purpose])
+	body = fmt.Sprintf(`
+        <h1>%s</h1>
+        <p>%s</p>
+        <p><strong>%s</strong></p>
+    `, html.EscapeString(subject),
+		html.EscapeString(fmt.Sprintf(i18n.Translate(tag, "Enter the following code in the app. It can only be used once and expires in %d minutes."), int(s.Config.TTL.Minutes()))),
+		code)
+	return subject, body
+}
+
+// discard deletes the code for purpose and address; failures only delay its expiry
+func (s *Store) discard(ctx context.Context, tenantID string, purpose Purpose, email string) {
+	_ = s.Session.Query(`DELETE FROM email_codes WHERE tenant = ? AND purpose = ? AND email = ?`, tenantID, string(purpose), email).WithContext(ctx).Exec()
+}
+
+// hash binds a code to its purpose and address, so that equal codes have
+// different hashes, keyed with the secret so that reading the table is not
+// enough to recover codes
+func (s *Store) hash(purpose Purpose, email, code string) string {
+	mac := hmac.New(sha256.New, []byte(s.Config.Secret))
+	mac.Write([]byte(string(purpose) + "\x00" + email + "\x00" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
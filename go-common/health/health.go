@@ -0,0 +1,143 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/migrate"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Check reports whether a dependency is usable
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check in the /readyz response
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Checker runs named readiness checks
+type Checker struct {
+	// Timeout bounds each check (default: 2s)
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	names  []string
+	checks map[string]Check
+}
+
+// Add registers a readiness check under name
+func (h *Checker) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checks == nil {
+		h.checks = make(map[string]Check)
+	}
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// Run executes all checks concurrently and reports whether all passed
+func (h *Checker) Run(ctx context.Context) (bool, map[string]Result) {
+	h.mu.Lock()
+	names := append([]string(nil), h.names...)
+	checks := make(map[string]Check, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.Unlock()
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+
+	results := make(map[string]Result, len(names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			result := Result{Status: "ok"}
+			if err := check(checkCtx); err != nil {
+				result = Result{Status: "fail", Error: err.Error()}
+			}
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, checks[name])
+	}
+	wg.Wait()
+
+	ready := true
+	for _, result := range results {
+		if result.Status != "ok" {
+			ready = false
+		}
+	}
+	return ready, results
+}
+
+// Liveness answers /healthz: the process is up and serving requests
+func Liveness(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// Readiness answers /readyz with the result of every check, and 503 if any failed
+func (h *Checker) Readiness(c *fiber.Ctx) error {
+	ready, results := h.Run(c.UserContext())
+	status, code := "ok", fiber.StatusOK
+	if !ready {
+		status, code = "fail", fiber.StatusServiceUnavailable
+	}
+	return c.Status(code).JSON(fiber.Map{
+		"status": status,
+		"checks": results,
+	})
+}
+
+// CassandraCheck runs a cheap query against the local system table
+func CassandraCheck(session *gocql.Session) Check {
+	return func(ctx context.Context) error {
+		var now gocql.UUID
+		return session.Query(`SELECT now() FROM system.local`).WithContext(ctx).Scan(&now)
+	}
+}
+
+// SchemaCheck fails until the keyspace has been migrated to at least expected
+func SchemaCheck(session *gocql.Session, expected int) Check {
+	return func(ctx context.Context) error {
+		runner := &migrate.Runner{Session: session}
+		version, err := runner.Version()
+		if err != nil {
+			return err
+		}
+		if version < expected {
+			return fmt.Errorf("schema is at version %d, expected %d", version, expected)
+		}
+		return nil
+	}
+}
+
+// TCPCheck dials addr, e.g. an SMTP server, and closes the connection
+func TCPCheck(addr string) Check {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -0,0 +1,117 @@
+// Package i18n translates the messages returned to clients and sent by email.
+//
+// Messages are written in English in the code and the English text is the
+// key of the catalogue; locales/<tag>.json maps it to a translation. Missing
+// translations fall back to English, so clients should rely on the error
+// codes sent alongside messages rather than on their text.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
+)
+
+//go:embed locales/*.json
+var files embed.FS
+
+// Default is the language messages are written in
+var Default = language.English
+
+const localeKey = "locale"
+
+var (
+	supported = []language.Tag{Default}
+	catalogue = map[language.Tag]map[string]string{}
+	matcher   language.Matcher
+)
+
+func init() {
+	entries, err := fs.Glob(files, "locales/*.json")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		tag := language.MustParse(strings.TrimSuffix(path.Base(entry), ".json"))
+		data, err := files.ReadFile(entry)
+		if err != nil {
+			panic(err)
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("i18n: %s: %v", entry, err))
+		}
+		supported = append(supported, tag)
+		catalogue[tag] = messages
+	}
+	matcher = language.NewMatcher(supported)
+}
+
+// Supported returns the languages messages are available in, Default first
+func Supported() []language.Tag {
+	return append([]language.Tag(nil), supported...)
+}
+
+// Parse resolves a locale such as "de" or "fr-CA" to a supported language.
+// It reports false when no supported language is close enough.
+func Parse(locale string) (language.Tag, bool) {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return Default, false
+	}
+	_, index, confidence := matcher.Match(tag)
+	if confidence == language.No {
+		return Default, false
+	}
+	return supported[index], true
+}
+
+// Match picks the best supported language for an Accept-Language header
+func Match(acceptLanguage string) language.Tag {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return Default
+	}
+	_, index, confidence := matcher.Match(tags...)
+	if confidence == language.No {
+		return Default
+	}
+	return supported[index]
+}
+
+// Translate returns message in the language tag, or message itself when it
+// has no translation
+func Translate(tag language.Tag, message string) string {
+	if translated, ok := catalogue[tag][message]; ok {
+		return translated
+	}
+	return message
+}
+
+// Locale returns the language of the response to c: the one set with
+// SetLocale, e.g. from a user's preference, or else the best match for the
+// request's Accept-Language header
+func Locale(c *fiber.Ctx) language.Tag {
+	if tag, ok := c.Locals(localeKey).(language.Tag); ok {
+		return tag
+	}
+	tag := Match(c.Get(fiber.HeaderAcceptLanguage))
+	c.Locals(localeKey, tag)
+	return tag
+}
+
+// SetLocale makes tag the language of the response to c
+func SetLocale(c *fiber.Ctx, tag language.Tag) {
+	c.Locals(localeKey, tag)
+}
+
+// T translates message into the language of the response to c
+func T(c *fiber.Ctx, message string) string {
+	return Translate(Locale(c), message)
+}
@@ -0,0 +1,117 @@
+// Package identity validates and normalizes the usernames and email
+// addresses users register with, and derives the case-insensitive keys under
+// which they are claimed in the lookup tables.
+package identity
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Limits on usernames and email addresses
+const (
+	UsernameMinLength = 3
+	UsernameMaxLength = 32
+	EmailMaxLength    = 254
+	emailLocalMax     = 64
+)
+
+// Error is a validation failure with a stable, machine-readable code
+type Error struct {
+	code    string
+	message string
+}
+
+// NewError returns an Error with code, for rules defined outside this package
+func NewError(code, message string) *Error {
+	return &Error{code: code, message: message}
+}
+
+func (e *Error) Error() string {
+	return e.message
+}
+
+// FieldCode returns the code of the failure, e.g. EMAIL_SYNTAX
+func (e *Error) FieldCode() string {
+	return e.code
+}
+
+var (
+	ErrUsernameLength     = NewError("USERNAME_LENGTH", "username must be between 3 and 32 characters long")
+	ErrUsernameCharacters = NewError("USERNAME_CHARACTERS", "username may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit")
+	ErrEmailLength        = NewError("EMAIL_LENGTH", "email address must be at most 254 characters long")
+	ErrEmailSyntax        = NewError("EMAIL_SYNTAX", "email address is not valid")
+	ErrEmailDomain        = NewError("EMAIL_DOMAIN", "email address has an invalid domain")
+)
+
+// usernamePattern allows letters, digits and their combining marks, plus a
+// few separators after the first character
+var usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{M}\p{N}._-]*$`)
+
+var fold = cases.Fold()
+
+// NormalizeUsername trims and NFKC-normalizes raw and checks it against the
+// username rules. The result keeps its case for display.
+func NormalizeUsername(raw string) (string, error) {
+	username := norm.NFKC.String(strings.TrimSpace(raw))
+	if n := utf8.RuneCountInString(username); n < UsernameMinLength || n > UsernameMaxLength {
+		return "", ErrUsernameLength
+	}
+	if !usernamePattern.MatchString(username) {
+		return "", ErrUsernameCharacters
+	}
+	return username, nil
+}
+
+// UsernameKey returns the case-folded form of a username under which it is
+// claimed, so that "Bob" and "bob" are the same name. It accepts raw input.
+func UsernameKey(username string) string {
+	return norm.NFKC.String(fold.String(norm.NFKC.String(strings.TrimSpace(username))))
+}
+
+// NormalizeEmail trims and NFKC-normalizes raw, checks it is a bare RFC 5322
+// address and converts an internationalized domain to its lowercase ASCII
+// form. The local part is kept as given.
+func NormalizeEmail(raw string) (string, error) {
+	email := norm.NFKC.String(strings.TrimSpace(raw))
+	if len(email) > EmailMaxLength {
+		return "", ErrEmailLength
+	}
+	// Display names, comments and angle brackets are not accepted
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrEmailSyntax
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+	if len(local) > emailLocalMax {
+		return "", ErrEmailSyntax
+	}
+	domain, err = idna.Lookup.ToASCII(domain)
+	if err != nil || !strings.Contains(domain, ".") {
+		return "", ErrEmailDomain
+	}
+
+	email = local + "@" + strings.ToLower(domain)
+	if len(email) > EmailMaxLength {
+		return "", ErrEmailLength
+	}
+	return email, nil
+}
+
+// EmailKey returns the case-insensitive form of an email address under which
+// it is claimed. It accepts raw input; addresses that do not normalize are
+// only trimmed and lowercased.
+func EmailKey(email string) string {
+	if normalized, err := NormalizeEmail(email); err == nil {
+		email = normalized
+	}
+	return fold.String(strings.TrimSpace(email))
+}
@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// New returns a JSON logger writing to stdout at the given level ("debug",
+// "info", "warn" or "error"). Every record passes through Redact first.
+func New(level string) (*slog.Logger, error) {
+	return NewWithWriter(os.Stdout, level)
+}
+
+// NewWithWriter is New with a custom destination
+func NewWithWriter(w io.Writer, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: Redact,
+	})
+	return slog.New(handler), nil
+}
+
+// Setup builds the logger for a service, tags it with the service name and
+// installs it as the default for both log/slog and the standard log package
+func Setup(service, level string) (*slog.Logger, error) {
+	logger, err := New(level)
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.With("service", service)
+	slog.SetDefault(logger)
+	return logger, nil
+}
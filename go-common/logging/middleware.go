@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/auth"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// RequestIDHeader carries the request ID in and out of a service
+	RequestIDHeader = "X-Request-ID"
+
+	loggerKey = "logger"
+)
+
+// Middleware attaches a logger carrying the request ID and method to every
+// request, and logs one line per request once it completes. The route pattern
+// is logged rather than the path, which may contain tokens.
+func Middleware(logger *slog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		requestID := c.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > 64 {
+			requestID, _ = auth.GenerateHexRandomToken(32)
+		}
+		c.Set(RequestIDHeader, requestID)
+
+		reqLogger := logger.With(
+			"request_id", requestID,
+			"method", c.Method(),
+		)
+		// Correlate with the trace started by tracing.Middleware, if any
+		if sc := trace.SpanContextFromContext(c.UserContext()); sc.HasTraceID() {
+			reqLogger = reqLogger.With("trace_id", sc.TraceID().String())
+		}
+		c.Locals(loggerKey, reqLogger)
+
+		err := c.Next()
+		if err != nil {
+			// Let the error handler set the response so that the status is logged correctly
+			if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+		}
+
+		reqLogger.Info("request completed",
+			"route", c.Route().Path,
+			"status", c.Response().StatusCode(),
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+		return nil
+	}
+}
+
+// FromCtx returns the request-scoped logger, or the default logger outside of
+// a request handled by Middleware
+func FromCtx(c *fiber.Ctx) *slog.Logger {
+	if logger, ok := c.Locals(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
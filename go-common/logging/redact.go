@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces the value of sensitive attributes
+const Redacted = "[REDACTED]"
+
+var (
+	emailPattern = regexp.MustCompile(`([A-Za-z0-9._%+\-])[A-Za-z0-9._%+\-]*@([A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+	jwtPattern   = regexp.MustCompile(`eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`)
+	// apiKeyPattern matches the keys of the apikey package
+	apiKeyPattern = regexp.MustCompile(`lda_[0-9A-Za-z]{36}`)
+)
+
+// sensitiveKeys are attribute names whose values are never logged. A key also
+// matches when it ends in "_" followed by one of these, e.g. "refresh_token".
+var sensitiveKeys = []string{
+	"password", "secret", "token", "authorization", "cookie", "link", "api_key",
+}
+
+// Redact is a slog ReplaceAttr function that hides secrets and masks emails.
+// Attributes with sensitive keys are replaced wholesale; any other string or
+// error, including the message, has emails masked and JWTs and API keys removed.
+func Redact(_ []string, a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactString(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, RedactString(err.Error()))
+		}
+	}
+	return a
+}
+
+// RedactString masks emails as "j***@example.com" and replaces JWTs and API keys
+func RedactString(s string) string {
+	s = jwtPattern.ReplaceAllString(s, Redacted)
+	s = apiKeyPattern.ReplaceAllString(s, Redacted)
+	return emailPattern.ReplaceAllString(s, "$1***@$2")
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if key == sensitive || strings.HasSuffix(key, "_"+sensitive) {
+			return true
+		}
+	}
+	return false
+}
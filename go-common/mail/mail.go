@@ -0,0 +1,71 @@
+// Package mail sends HTML email through the configured SMTP server
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tracing"
+	"gopkg.in/gomail.v2"
+)
+
+// ErrNotConfigured is returned when SMTP_HOST is not set
+var ErrNotConfigured = errors.New("SMTP_HOST is not set")
+
+// Sender sends mail with the settings in Config
+type Sender struct {
+	Config config.SMTP
+}
+
+// Send delivers an HTML message to a single recipient, from the sender of
+// the tenant in ctx if it has one
+func (s Sender) Send(ctx context.Context, to, subject, body string) (err error) {
+	_, span := tracing.Start(ctx, "smtp.send")
+	defer func() { tracing.End(span, err) }()
+
+	// Mail can only be sent once SMTP is configured
+	if s.Config.Host == "" {
+		slog.Error("Cannot send email, SMTP_HOST is not set")
+		return ErrNotConfigured
+	}
+	if to == "" {
+		return errors.New("recipient email is empty")
+	}
+
+	from := s.Config.SenderEmail
+	if t := tenant.FromContext(ctx); t != nil && t.SenderEmail != "" {
+		from = t.SenderEmail
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
+
+	// Use an external SMTP server to send the email
+	d := gomail.NewDialer(s.Config.Host, s.Config.Port, s.Config.Username, s.Config.Password)
+
+	// Set TLS configuration (useful for enforcing TLS)
+	d.TLSConfig = &tls.Config{
+		ServerName: s.Config.Host,
+		MinVersion: tls.VersionTLS12, // Enforce a minimum version of TLS (e.g., TLS 1.2)
+	}
+
+	start := time.Now()
+	if err := d.DialAndSend(m); err != nil {
+		metrics.ObserveSince(metrics.SMTPSendDuration, start, "error")
+		slog.Error("Failed to send email", "email", to, "subject", subject, "error", err)
+		return err
+	}
+
+	metrics.ObserveSince(metrics.SMTPSendDuration, start, "ok")
+	slog.Info("Email sent", "email", to, "subject", subject)
+	return nil
+}
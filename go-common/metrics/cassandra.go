@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/cassandra"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CassandraQueryDuration observes queries and batches sent through gocql
+var CassandraQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "cassandra_query_duration_seconds",
+	Help:    "Duration of Cassandra queries by operation, table and result.",
+	Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+}, []string{"operation", "table", "status"})
+
+// CassandraObserver implements gocql.QueryObserver and gocql.BatchObserver
+type CassandraObserver struct{}
+
+func (CassandraObserver) ObserveQuery(_ context.Context, q gocql.ObservedQuery) {
+	operation, table := cassandra.DescribeStatement(q.Statement)
+	CassandraQueryDuration.WithLabelValues(operation, table, status(q.Err)).Observe(q.End.Sub(q.Start).Seconds())
+}
+
+func (CassandraObserver) ObserveBatch(_ context.Context, b gocql.ObservedBatch) {
+	CassandraQueryDuration.WithLabelValues("BATCH", "", status(b.Err)).Observe(b.End.Sub(b.Start).Seconds())
+}
+
+func status(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
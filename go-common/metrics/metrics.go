@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes counted by AuthOutcomes
+const (
+	OutcomeLoginSuccess    = "login_success"
+	OutcomeUnknownUser     = "unknown_user"
+	OutcomeBadPassword     = "bad_password"
+	OutcomeRefreshSuccess  = "refresh_success"
+	OutcomeRefreshExpired  = "refresh_expired"
+	OutcomeRefreshInvalid  = "refresh_invalid"
+	OutcomeLogout          = "logout"
+	OutcomeRegistered      = "registered"
+	OutcomeEmailVerified   = "email_verified"
+	OutcomePasswordReset   = "password_reset"
+	OutcomeRecoveryRequest = "recovery_requested"
+	OutcomeMagicLinkSent   = "magic_link_sent"
+	OutcomeMagicLinkLogin  = "magic_link_login"
+	OutcomeMagicLinkBad    = "magic_link_invalid"
+	OutcomeRateLimited     = "rate_limited"
+	OutcomeEmailCodeSent   = "email_code_sent"
+	OutcomeEmailCodeLogin  = "email_code_login"
+	OutcomeEmailCodeBad    = "email_code_invalid"
+	OutcomeOIDCLogin       = "oidc_login"
+	OutcomeOIDCFailed      = "oidc_failed"
+	OutcomeAccountDisabled = "account_disabled"
+)
+
+var (
+	// HTTPRequestDuration observes every request by route pattern and status
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// AuthOutcomes counts the results of authentication related operations
+	AuthOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_outcomes_total",
+		Help: "Authentication outcomes such as successful logins, bad passwords or expired refresh tokens.",
+	}, []string{"outcome"})
+
+	// PasswordHashDuration observes bcrypt hashing and comparison
+	PasswordHashDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "password_hash_duration_seconds",
+		Help:    "Duration of password hashing and comparison.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2, 4},
+	}, []string{"operation"})
+
+	// SMTPSendDuration observes outgoing mail delivery
+	SMTPSendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "smtp_send_duration_seconds",
+		Help:    "Duration of SMTP deliveries by result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"status"})
+
+	// WebhookDeliveries counts webhook events by final result
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Webhook deliveries by event type and result: delivered, failed or dropped.",
+	}, []string{"event", "result"})
+)
+
+// Middleware records HTTPRequestDuration. The route pattern is used as the
+// label so that tokens in paths do not create new series.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		if err := c.Next(); err != nil {
+			// Let the error handler set the response so that the status is recorded correctly
+			if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+		}
+		HTTPRequestDuration.WithLabelValues(c.Method(), c.Route().Path, strconv.Itoa(c.Response().StatusCode())).
+			Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
+
+// Handler serves the default registry in the Prometheus text format
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
+
+// Outcome increments AuthOutcomes for outcome
+func Outcome(outcome string) {
+	AuthOutcomes.WithLabelValues(outcome).Inc()
+}
+
+// ObserveSince records the time elapsed since start in h under labels
+func ObserveSince(h *prometheus.HistogramVec, start time.Time, labels ...string) {
+	h.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
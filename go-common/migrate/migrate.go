@@ -0,0 +1,314 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Migration is a numbered, forward-only schema change. Statements run first,
+// then Func, if set, for changes that CQL alone cannot express (e.g. backfills).
+type Migration struct {
+	Version    int
+	Name       string
+	Statements []string
+	Func       func(ctx context.Context, session *gocql.Session) error
+}
+
+// AppliedMigration is a row of the schema_migrations table
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// Runner applies migrations to the keyspace of its session, holding a
+// lightweight-transaction lock so that only one process migrates at a time
+type Runner struct {
+	Session    *gocql.Session
+	Migrations []Migration
+
+	// LockTTL bounds how long a crashed runner can keep the lock; a running one
+	// renews it every third of the TTL (default: 5m)
+	LockTTL time.Duration
+	// LockRetry is the wait between attempts to take a held lock (default: 2s)
+	LockRetry time.Duration
+	// Owner identifies this runner in the lock table (default: hostname and pid)
+	Owner string
+}
+
+const lockName = "schema"
+
+var fileNamePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.cql$`)
+
+// Load reads migrations named like 0001_create_users.cql from the root of fsys,
+// sorted by version
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := fileNamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %q does not match NNNN_name.cql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %q and %q share version %d", other, entry.Name(), version)
+		}
+		seen[version] = entry.Name()
+
+		content, err := fs.ReadFile(fsys, path.Join(".", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version:    version,
+			Name:       match[2],
+			Statements: splitStatements(string(content)),
+		})
+	}
+
+	Sort(migrations)
+	return migrations, nil
+}
+
+// splitStatements strips "--" comments and splits a CQL script on semicolons
+func splitStatements(script string) []string {
+	var b strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	var statements []string
+	for _, stmt := range strings.Split(b.String(), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// Sort orders migrations by version
+func Sort(migrations []Migration) {
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+}
+
+// Latest returns the highest version among migrations, or 0 if there are none
+func Latest(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Up applies every migration that has not been applied yet, in order. It stops
+// with an error if the lock cannot be renewed, since another runner may then
+// take it.
+func (r *Runner) Up(ctx context.Context) ([]Migration, error) {
+	if err := r.ensureTables(); err != nil {
+		return nil, err
+	}
+	if err := r.lock(ctx); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		r.renew(ctx, cancel)
+	}()
+	defer func() {
+		cancel(nil)
+		<-renewed
+		r.unlock()
+	}()
+
+	applied, err := r.Applied()
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+
+	var ran []Migration
+	for _, m := range r.Migrations {
+		if done[m.Version] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ran, context.Cause(ctx)
+		}
+		slog.Info("Applying migration", "version", m.Version, "name", m.Name)
+		for _, stmt := range m.Statements {
+			if err := r.Session.Query(stmt).WithContext(ctx).Exec(); err != nil {
+				return ran, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, cause(ctx, err))
+			}
+		}
+		if m.Func != nil {
+			if err := m.Func(ctx, r.Session); err != nil {
+				return ran, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, cause(ctx, err))
+			}
+		}
+		if err := r.Session.Query(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.Version, m.Name, time.Now()).WithContext(ctx).Exec(); err != nil {
+			return ran, fmt.Errorf("recording migration %04d_%s: %w", m.Version, m.Name, cause(ctx, err))
+		}
+		ran = append(ran, m)
+	}
+
+	return ran, nil
+}
+
+// cause returns why ctx was cancelled, e.g. a lost lock, in place of the error
+// a query failed with because of it
+func cause(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// Applied lists the migrations recorded in schema_migrations, sorted by version
+func (r *Runner) Applied() ([]AppliedMigration, error) {
+	var applied []AppliedMigration
+	var m AppliedMigration
+	iter := r.Session.Query(`SELECT version, name, applied_at FROM schema_migrations`).Iter()
+	for iter.Scan(&m.Version, &m.Name, &m.AppliedAt) {
+		applied = append(applied, m)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	sort.Slice(applied, func(i, j int) bool { return applied[i].Version < applied[j].Version })
+	return applied, nil
+}
+
+// Version returns the highest applied migration version, or 0 if none is applied
+func (r *Runner) Version() (int, error) {
+	applied, err := r.Applied()
+	if err != nil || len(applied) == 0 {
+		return 0, err
+	}
+	return applied[len(applied)-1].Version, nil
+}
+
+func (r *Runner) ensureTables() error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INT PRIMARY KEY,
+            name TEXT,
+            applied_at TIMESTAMP
+        )`,
+		`CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+            name TEXT PRIMARY KEY,
+            owner TEXT,
+            acquired_at TIMESTAMP
+        )`,
+	} {
+		if err := r.Session.Query(stmt).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock takes the migration lock with INSERT ... IF NOT EXISTS, waiting while
+// another runner holds it. The TTL frees the lock if its holder dies.
+func (r *Runner) lock(ctx context.Context) error {
+	ttl, retry := r.lockTTL(), r.LockRetry
+	if retry <= 0 {
+		retry = 2 * time.Second
+	}
+	if r.Owner == "" {
+		hostname, _ := os.Hostname()
+		r.Owner = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	for {
+		existing := make(map[string]interface{})
+		applied, err := r.Session.Query(`INSERT INTO schema_migrations_lock (name, owner, acquired_at) VALUES (?, ?, ?) IF NOT EXISTS USING TTL ?`,
+			lockName, r.Owner, time.Now(), int(ttl.Seconds())).WithContext(ctx).MapScanCAS(existing)
+		if err != nil {
+			return fmt.Errorf("acquiring migration lock: %w", err)
+		}
+		if applied {
+			return nil
+		}
+
+		slog.Info("Migration lock held, waiting", "owner", existing["owner"])
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+// renew extends the lock's TTL every third of it until ctx is done. If the
+// lock was lost or cannot be renewed, it cancels ctx with the reason.
+func (r *Runner) renew(ctx context.Context, cancel context.CancelCauseFunc) {
+	ttl := r.lockTTL()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		applied, err := r.Session.Query(`UPDATE schema_migrations_lock USING TTL ? SET owner = ?, acquired_at = ? WHERE name = ? IF owner = ?`,
+			int(ttl.Seconds()), r.Owner, time.Now(), lockName, r.Owner).WithContext(ctx).MapScanCAS(make(map[string]interface{}))
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			cancel(fmt.Errorf("renewing migration lock: %w", err))
+			return
+		case !applied:
+			cancel(errors.New("migration lock expired and was released or taken by another runner"))
+			return
+		}
+	}
+}
+
+// lockTTL returns LockTTL, or its default, in whole seconds as Cassandra TTLs are
+func (r *Runner) lockTTL() time.Duration {
+	if r.LockTTL <= 0 {
+		return 5 * time.Minute
+	}
+	return max(r.LockTTL.Round(time.Second), time.Second)
+}
+
+func (r *Runner) unlock() {
+	applied, err := r.Session.Query(`DELETE FROM schema_migrations_lock WHERE name = ? IF owner = ?`, lockName, r.Owner).
+		MapScanCAS(make(map[string]interface{}))
+	if err != nil || !applied {
+		slog.Error("Error releasing migration lock", "applied", applied, "error", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Package openapi serves a service's OpenAPI 3 document and validates
+// incoming requests against it, so that handlers only ever see requests of
+// the documented shape.
+package openapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// Spec is a loaded and validated OpenAPI document
+type Spec struct {
+	doc    *openapi3.T
+	json   []byte
+	router routers.Router
+}
+
+// Load parses a YAML or JSON OpenAPI document and checks that it is valid
+func Load(data []byte) (*Spec, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(data)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("openapi: invalid document: %w", err)
+	}
+	encoded, err := doc.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	return &Spec{doc: doc, json: encoded, router: router}, nil
+}
+
+// Handler serves the document as JSON, for /openapi.json
+func (s *Spec) Handler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return c.Send(s.json)
+}
+
+// Middleware rejects requests to documented operations whose parameters or
+// body do not match the document with a VALIDATION_FAILED error listing every
+// invalid field. Requests to undocumented routes are passed on untouched.
+// Authentication is left to the handlers.
+func (s *Spec) Middleware() fiber.Handler {
+	options := &openapi3filter.Options{
+		MultiError:         true,
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	}
+	return func(c *fiber.Ctx) error {
+		req, err := adaptor.ConvertRequest(c, false)
+		if err != nil {
+			return response.New(response.CodeBadRequest, "Invalid request")
+		}
+		route, pathParams, err := s.router.FindRoute(req)
+		if err != nil {
+			// Unknown paths and methods are answered by Fiber itself
+			return c.Next()
+		}
+
+		err = openapi3filter.ValidateRequest(c.UserContext(), &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    options,
+		})
+		if err != nil {
+			return response.Invalid(fieldErrors(err)...)
+		}
+		return c.Next()
+	}
+}
+
+// fieldErrors flattens the errors of ValidateRequest into one entry per field
+func fieldErrors(err error) []response.FieldError {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		var fields []response.FieldError
+		for _, inner := range e {
+			fields = append(fields, fieldErrors(inner)...)
+		}
+		return fields
+
+	case *openapi3filter.RequestError:
+		if e.Parameter != nil {
+			// Report the parameter itself rather than a pointer into its value
+			message := e.Reason
+			var schemaErr *openapi3.SchemaError
+			if errors.As(e.Err, &schemaErr) {
+				message = schemaErr.Reason
+			} else if message == "" && e.Err != nil {
+				message = e.Err.Error()
+			}
+			code := response.CodeFieldInvalid
+			if schemaErr != nil {
+				code = schemaCode(schemaErr)
+			} else if errors.Is(e.Err, openapi3filter.ErrInvalidRequired) {
+				code = response.CodeFieldRequired
+			}
+			return []response.FieldError{{Field: e.Parameter.Name, Code: code, Message: message}}
+		}
+		if e.Err != nil {
+			if _, ok := e.Err.(openapi3.MultiError); ok {
+				return fieldErrors(e.Err)
+			}
+			if _, ok := e.Err.(*openapi3.SchemaError); ok {
+				return fieldErrors(e.Err)
+			}
+		}
+		message := e.Reason
+		if message == "" && e.Err != nil {
+			message = e.Err.Error()
+		}
+		return []response.FieldError{{Field: "body", Code: response.CodeFieldInvalid, Message: message}}
+
+	case *openapi3.SchemaError:
+		field := strings.Join(e.JSONPointer(), ".")
+		if field == "" {
+			field = "body"
+		}
+		return []response.FieldError{{Field: field, Code: schemaCode(e), Message: e.Reason}}
+	}
+
+	return []response.FieldError{{Field: "request", Code: response.CodeFieldInvalid, Message: err.Error()}}
+}
+
+// schemaCode maps the schema keyword a value violated to a field code
+func schemaCode(err *openapi3.SchemaError) response.Code {
+	switch err.SchemaField {
+	case "required":
+		return response.CodeFieldRequired
+	case "type", "nullable":
+		return response.CodeFieldType
+	case "format", "pattern":
+		return response.CodeFieldFormat
+	case "minLength", "maxLength", "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "minItems", "maxItems", "minProperties", "maxProperties":
+		return response.CodeFieldOutOfRange
+	case "enum", "additionalProperties", "uniqueItems":
+		return response.CodeFieldNotAllowed
+	}
+	return response.CodeFieldInvalid
+}
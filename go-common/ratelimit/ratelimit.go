@@ -0,0 +1,50 @@
+// Package ratelimit counts events per key in Cassandra so that every instance
+// of a service enforces the same limit
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Limiter allows at most Limit events per key within a sliding Window. Events
+// are stored with a TTL of Window, so nothing needs to be cleaned up.
+// Concurrent requests may overshoot the limit slightly; it is a brake, not a
+// hard guarantee.
+type Limiter struct {
+	Session *gocql.Session
+	// Name separates the counters of different limiters sharing the table
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+// Events over the limit are not recorded, so a blocked client is let through
+// again once its earlier events leave the window.
+func (l *Limiter) Allow(ctx context.Context, key string) (bool, error) {
+	now := time.Now()
+	var count int
+	err := l.Session.Query(`SELECT COUNT(*) FROM rate_limit_events WHERE name = ? AND key = ? AND event_id > maxTimeuuid(?)`,
+		l.Name, key, now.Add(-l.Window)).WithContext(ctx).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count >= l.Limit {
+		return false, nil
+	}
+
+	err = l.Session.Query(`INSERT INTO rate_limit_events (name, key, event_id) VALUES (?, ?, ?) USING TTL ?`,
+		l.Name, key, gocql.UUIDFromTime(now), int(l.Window.Seconds())).WithContext(ctx).Exec()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Reset forgets the events of key, e.g. after a successful attempt
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.Session.Query(`DELETE FROM rate_limit_events WHERE name = ? AND key = ?`, l.Name, key).WithContext(ctx).Exec()
+}
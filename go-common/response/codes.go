@@ -0,0 +1,119 @@
+package response
+
+import "github.com/gofiber/fiber/v2"
+
+// Code is a stable, machine-readable error code. Clients may rely on codes,
+// so existing ones must never change meaning.
+type Code string
+
+const (
+	CodeBadRequest          Code = "BAD_REQUEST"
+	CodeValidationFailed    Code = "VALIDATION_FAILED"
+	CodeUnauthorized        Code = "UNAUTHORIZED"
+	CodeInvalidCredentials  Code = "AUTH_INVALID_CREDENTIALS"
+	CodeTokenInvalid        Code = "TOKEN_INVALID"
+	CodeTokenExpired        Code = "TOKEN_EXPIRED"
+	CodeForbidden           Code = "FORBIDDEN"
+	CodeNotFound            Code = "NOT_FOUND"
+	CodeUserNotFound        Code = "USER_NOT_FOUND"
+	CodeMethodNotAllowed    Code = "METHOD_NOT_ALLOWED"
+	CodeUsernameTaken       Code = "USERNAME_TAKEN"
+	CodeEmailTaken          Code = "EMAIL_TAKEN"
+	CodeRequestTooLarge     Code = "REQUEST_TOO_LARGE"
+	CodeRateLimited         Code = "RATE_LIMITED"
+	CodeCodeInvalid         Code = "CODE_INVALID"
+	CodeCodeAttempts        Code = "CODE_ATTEMPTS_EXCEEDED"
+	CodeInternal            Code = "INTERNAL_ERROR"
+	CodeEmailDeliveryFailed Code = "EMAIL_DELIVERY_FAILED"
+	CodeUnavailable         Code = "SERVICE_UNAVAILABLE"
+	CodeTenantUnknown       Code = "TENANT_UNKNOWN"
+	CodeLastOwner           Code = "ORG_LAST_OWNER"
+	CodeInvitationMismatch  Code = "INVITATION_EMAIL_MISMATCH"
+	CodeRegistrationClosed  Code = "REGISTRATION_CLOSED"
+	CodeExportNotReady      Code = "EXPORT_NOT_READY"
+	CodeAccountSuspended    Code = "ACCOUNT_SUSPENDED"
+	CodeAccountBanned       Code = "ACCOUNT_BANNED"
+	CodeAccountPending      Code = "ACCOUNT_PENDING"
+)
+
+// Field codes tell why a single field of a request is invalid. They appear in
+// the fields of a VALIDATION_FAILED error and never as the error code itself.
+const (
+	CodeFieldRequired      Code = "FIELD_REQUIRED"
+	CodeFieldType          Code = "FIELD_TYPE"
+	CodeFieldFormat        Code = "FIELD_FORMAT"
+	CodeFieldOutOfRange    Code = "FIELD_OUT_OF_RANGE"
+	CodeFieldNotAllowed    Code = "FIELD_NOT_ALLOWED"
+	CodeFieldInvalid       Code = "FIELD_INVALID"
+	CodeUsernameLength     Code = "USERNAME_LENGTH"
+	CodeUsernameCharacters Code = "USERNAME_CHARACTERS"
+	CodeEmailLength        Code = "EMAIL_LENGTH"
+	CodeEmailSyntax        Code = "EMAIL_SYNTAX"
+	CodeEmailDomain        Code = "EMAIL_DOMAIN"
+	CodePasswordTooShort   Code = "PASSWORD_TOO_SHORT"
+	CodePasswordTooLong    Code = "PASSWORD_TOO_LONG"
+	CodeLocaleUnsupported  Code = "LOCALE_UNSUPPORTED"
+)
+
+// statuses maps every code to the HTTP status it is returned with
+var statuses = map[Code]int{
+	CodeBadRequest:          fiber.StatusBadRequest,
+	CodeValidationFailed:    fiber.StatusBadRequest,
+	CodeUnauthorized:        fiber.StatusUnauthorized,
+	CodeInvalidCredentials:  fiber.StatusUnauthorized,
+	CodeTokenInvalid:        fiber.StatusUnauthorized,
+	CodeTokenExpired:        fiber.StatusUnauthorized,
+	CodeForbidden:           fiber.StatusForbidden,
+	CodeNotFound:            fiber.StatusNotFound,
+	CodeUserNotFound:        fiber.StatusNotFound,
+	CodeMethodNotAllowed:    fiber.StatusMethodNotAllowed,
+	CodeUsernameTaken:       fiber.StatusConflict,
+	CodeEmailTaken:          fiber.StatusConflict,
+	CodeRequestTooLarge:     fiber.StatusRequestEntityTooLarge,
+	CodeRateLimited:         fiber.StatusTooManyRequests,
+	CodeCodeInvalid:         fiber.StatusUnauthorized,
+	CodeCodeAttempts:        fiber.StatusTooManyRequests,
+	CodeInternal:            fiber.StatusInternalServerError,
+	CodeEmailDeliveryFailed: fiber.StatusBadGateway,
+	CodeUnavailable:         fiber.StatusServiceUnavailable,
+	CodeTenantUnknown:       fiber.StatusBadRequest,
+	CodeLastOwner:           fiber.StatusConflict,
+	CodeInvitationMismatch:  fiber.StatusForbidden,
+	CodeRegistrationClosed:  fiber.StatusForbidden,
+	CodeExportNotReady:      fiber.StatusConflict,
+	CodeAccountSuspended:    fiber.StatusForbidden,
+	CodeAccountBanned:       fiber.StatusForbidden,
+	CodeAccountPending:      fiber.StatusForbidden,
+}
+
+// Status returns the HTTP status for c; unknown codes are internal errors
+func (c Code) Status() int {
+	if status, ok := statuses[c]; ok {
+		return status
+	}
+	return fiber.StatusInternalServerError
+}
+
+// codeForStatus picks a code for errors raised by Fiber itself, e.g. for
+// unknown routes or oversized bodies
+func codeForStatus(status int) Code {
+	switch status {
+	case fiber.StatusBadRequest:
+		return CodeBadRequest
+	case fiber.StatusUnauthorized:
+		return CodeUnauthorized
+	case fiber.StatusForbidden:
+		return CodeForbidden
+	case fiber.StatusNotFound:
+		return CodeNotFound
+	case fiber.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case fiber.StatusRequestEntityTooLarge:
+		return CodeRequestTooLarge
+	case fiber.StatusTooManyRequests:
+		return CodeRateLimited
+	case fiber.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	return CodeInternal
+}
@@ -0,0 +1,159 @@
+// Package response defines the JSON envelope shared by all services and the
+// typed errors handlers return instead of writing error responses themselves.
+//
+// Every response has the shape
+//
+//	{"status": true, "message": "...", "data": {...}}
+//	{"status": false, "message": "...", "error": {"code": "TOKEN_EXPIRED", "message": "...", "fields": [...]}}
+//
+// Handlers return *Error values and ErrorHandler, installed as the Fiber
+// error handler, turns them into responses. The wrapped cause of an error is
+// logged, never sent to the client. Messages are translated into the language
+// chosen by i18n.Locale; codes are not, so clients can localize on their own.
+package response
+
+import (
+	"errors"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Envelope is the body of every JSON response
+type Envelope struct {
+	Status  bool       `json:"status"`
+	Message string     `json:"message,omitempty"`
+	Data    any        `json:"data,omitempty"`
+	Error   *ErrorBody `json:"error,omitempty"`
+}
+
+// ErrorBody describes a failed request
+type ErrorBody struct {
+	Code    Code         `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError points at a single invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// Field reports err as the reason field is invalid. Errors with a FieldCode
+// method, like those of the identity package, keep their code; any other
+// error is reported as FIELD_INVALID.
+func Field(field string, err error) FieldError {
+	code := CodeFieldInvalid
+	var coded interface{ FieldCode() string }
+	if errors.As(err, &coded) {
+		code = Code(coded.FieldCode())
+	}
+	return FieldError{Field: field, Code: code, Message: err.Error()}
+}
+
+// Error is returned by handlers to fail a request with Code
+type Error struct {
+	Code    Code
+	Message string
+	Fields  []FieldError
+	// Err is the internal cause; it is logged but not returned to the client
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return string(e.Code) + ": " + e.Message + ": " + e.Err.Error()
+	}
+	return string(e.Code) + ": " + e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New returns an error with code and a client facing message
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Wrap returns an error with code whose cause err is only logged
+func Wrap(code Code, err error, message string) *Error {
+	return &Error{Code: code, Message: message, Err: err}
+}
+
+// Internal returns an INTERNAL_ERROR whose cause err is only logged
+func Internal(err error, message string) *Error {
+	return Wrap(CodeInternal, err, message)
+}
+
+// Invalid returns a VALIDATION_FAILED error listing the invalid fields
+func Invalid(fields ...FieldError) *Error {
+	return &Error{Code: CodeValidationFailed, Message: "Validation failed", Fields: fields}
+}
+
+// Success writes a successful response with an optional message and data
+func Success(c *fiber.Ctx, status int, message string, data any) error {
+	if message != "" {
+		message = translate(c, message)
+	}
+	return c.Status(status).JSON(Envelope{
+		Status:  true,
+		Message: message,
+		Data:    data,
+	})
+}
+
+// ErrorHandler is the Fiber error handler. It writes *Error values with the
+// status of their code, maps *fiber.Error values onto the catalogue and hides
+// everything else behind INTERNAL_ERROR.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	var e *Error
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &e):
+	case errors.As(err, &fiberErr):
+		e = New(codeForStatus(fiberErr.Code), fiberErr.Message)
+		if e.Code == CodeInternal {
+			e = Internal(err, "Internal server error")
+		}
+	default:
+		e = Internal(err, "Internal server error")
+	}
+
+	status := e.Code.Status()
+	if e.Err != nil {
+		logger := logging.FromCtx(c)
+		if status >= fiber.StatusInternalServerError {
+			logger.Error(e.Message, "code", e.Code, "error", e.Err)
+		} else {
+			logger.Info(e.Message, "code", e.Code, "error", e.Err)
+		}
+	}
+
+	message := translate(c, e.Message)
+	fields := make([]FieldError, len(e.Fields))
+	for i, field := range e.Fields {
+		field.Message = i18n.T(c, field.Message)
+		fields[i] = field
+	}
+	return c.Status(status).JSON(Envelope{
+		Status:  false,
+		Message: message,
+		Error: &ErrorBody{
+			Code:    e.Code,
+			Message: message,
+			Fields:  fields,
+		},
+	})
+}
+
+// translate returns message in the language of the response and labels the
+// response with that language
+func translate(c *fiber.Ctx, message string) string {
+	c.Set(fiber.HeaderContentLanguage, i18n.Locale(c).String())
+	c.Vary(fiber.HeaderAcceptLanguage)
+	return i18n.T(c, message)
+}
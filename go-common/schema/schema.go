@@ -0,0 +1,214 @@
+package schema
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"log/slog"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/migrate"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+)
+
+//go:embed migrations/*.cql
+var files embed.FS
+
+// funcMigrations are the migrations written in Go, merged with the CQL files
+var funcMigrations = []migrate.Migration{
+	{Version: 5, Name: "backfill_lookup_tables", Func: backfillLookupTables},
+	{Version: 9, Name: "fold_lookup_keys", Func: foldLookupKeys},
+	{Version: 18, Name: "copy_lookups_to_default_tenant", Func: copyLookupsToDefaultTenant},
+	{Version: 26, Name: "index_audit_events_by_actor", Func: indexAuditEventsByActor},
+}
+
+// Migrations returns the migrations for the user_management keyspace shared by
+// all services
+func Migrations() ([]migrate.Migration, error) {
+	sub, err := fs.Sub(files, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := migrate.Load(sub)
+	if err != nil {
+		return nil, err
+	}
+	migrations = append(migrations, funcMigrations...)
+	migrate.Sort(migrations)
+	return migrations, nil
+}
+
+// Migrate brings the session's keyspace up to the latest schema version
+func Migrate(ctx context.Context, session *gocql.Session) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	runner := &migrate.Runner{Session: session, Migrations: migrations}
+	_, err = runner.Up(ctx)
+	return err
+}
+
+// backfillLookupTables claims the username and email of every existing user.
+// Duplicates left over from before the lookup tables are logged and skipped;
+// the first account to be claimed keeps the name.
+func backfillLookupTables(ctx context.Context, session *gocql.Session) error {
+	var (
+		id       gocql.UUID
+		username string
+		email    string
+	)
+	iter := session.Query(`SELECT id, username, email FROM users`).WithContext(ctx).PageSize(500).Iter()
+	for iter.Scan(&id, &username, &email) {
+		claims := []struct{ table, column, value string }{
+			{"users_by_username", "username", username},
+			{"users_by_email", "email", email},
+		}
+		for _, claim := range claims {
+			if claim.value == "" {
+				continue
+			}
+			existing := make(map[string]interface{})
+			applied, err := session.Query(`INSERT INTO `+claim.table+` (`+claim.column+`, user_id) VALUES (?, ?) IF NOT EXISTS`, claim.value, id).
+				WithContext(ctx).MapScanCAS(existing)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			if !applied && existing["user_id"] != id {
+				slog.Warn("Skipping duplicate claim", "column", claim.column, "user_id", id, "claimed_by", existing["user_id"])
+			}
+		}
+	}
+	return iter.Close()
+}
+
+// foldLookupKeys re-claims every username and email under its case-insensitive
+// key. When two accounts fold to the same key the first one claimed keeps it
+// and the other keeps its old claim, which is logged for an operator to resolve.
+func foldLookupKeys(ctx context.Context, session *gocql.Session) error {
+	var (
+		id       gocql.UUID
+		username string
+		email    string
+	)
+	iter := session.Query(`SELECT id, username, email FROM users`).WithContext(ctx).PageSize(500).Iter()
+	for iter.Scan(&id, &username, &email) {
+		claims := []struct{ table, column, value, key string }{
+			{"users_by_username", "username", username, identity.UsernameKey(username)},
+			{"users_by_email", "email", email, identity.EmailKey(email)},
+		}
+		for _, claim := range claims {
+			if claim.value == "" || claim.key == claim.value {
+				continue
+			}
+			existing := make(map[string]interface{})
+			applied, err := session.Query(`INSERT INTO `+claim.table+` (`+claim.column+`, user_id) VALUES (?, ?) IF NOT EXISTS`, claim.key, id).
+				WithContext(ctx).MapScanCAS(existing)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			if !applied && existing["user_id"] != id {
+				slog.Warn("Case-insensitive key already claimed, keeping the old claim", "column", claim.column, "user_id", id, "claimed_by", existing["user_id"])
+				continue
+			}
+			if _, err := session.Query(`DELETE FROM `+claim.table+` WHERE `+claim.column+` = ? IF user_id = ?`, claim.value, id).
+				WithContext(ctx).MapScanCAS(make(map[string]interface{})); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+	}
+	return iter.Close()
+}
+
+// copyLookupsToDefaultTenant claims every username, email and linked identity
+// in the default tenant's lookup tables. Existing claims are kept, so the
+// migration can be run again after a failure.
+func copyLookupsToDefaultTenant(ctx context.Context, session *gocql.Session) error {
+	var (
+		key    string
+		userID gocql.UUID
+	)
+	claims := []struct{ from, to, column string }{
+		{"users_by_username", "tenant_users_by_username", "username"},
+		{"users_by_email", "tenant_users_by_email", "email"},
+	}
+	for _, claim := range claims {
+		iter := session.Query(`SELECT ` + claim.column + `, user_id FROM ` + claim.from).WithContext(ctx).PageSize(500).Iter()
+		for iter.Scan(&key, &userID) {
+			if _, err := session.Query(`INSERT INTO `+claim.to+` (tenant, `+claim.column+`, user_id) VALUES (?, ?, ?) IF NOT EXISTS`, tenant.DefaultID, key, userID).
+				WithContext(ctx).MapScanCAS(make(map[string]interface{})); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		provider, subject, email string
+		createdAt                time.Time
+	)
+	iter := session.Query(`SELECT provider, subject, user_id, email, created_at FROM user_identities`).WithContext(ctx).PageSize(500).Iter()
+	for iter.Scan(&provider, &subject, &userID, &email, &createdAt) {
+		if _, err := session.Query(`INSERT INTO tenant_user_identities (tenant, provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
+			tenant.DefaultID, provider, subject, userID, email, createdAt).WithContext(ctx).MapScanCAS(make(map[string]interface{})); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// indexAuditEventsByActor indexes the events users recorded in the
+// partitions of others. Role changes and removals of organization members
+// named the acting user in their details; it becomes their actor.
+func indexAuditEventsByActor(ctx context.Context, session *gocql.Session) error {
+	var (
+		userID  gocql.UUID
+		day     time.Time
+		eventID gocql.UUID
+		actor   string
+		details map[string]string
+	)
+	iter := session.Query(`SELECT user_id, day, event_id, actor, details FROM audit_events`).WithContext(ctx).PageSize(500).Iter()
+	for iter.Scan(&userID, &day, &eventID, &actor, &details) {
+		for _, key := range []string{"changed_by", "removed_by"} {
+			by, ok := details[key]
+			if !ok {
+				continue
+			}
+			actor = by
+			if err := session.Query(`UPDATE audit_events SET actor = ?, details = details - ? WHERE user_id = ? AND day = ? AND event_id = ?`,
+				actor, []string{key}, userID, day, eventID).WithContext(ctx).Exec(); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if !audit.ActedForOther(userID, actor) {
+			continue
+		}
+		if err := session.Query(`INSERT INTO audit_events_by_actor (actor, event_id, user_id) VALUES (?, ?, ?)`, actor, eventID, userID).
+			WithContext(ctx).Exec(); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// Latest returns the schema version the code in this module expects
+func Latest() (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	return migrate.Latest(migrations), nil
+}
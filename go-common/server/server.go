@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Serve listens on addr until ctx is cancelled, then stops accepting new
+// connections and waits for in-flight requests and for workers, which are
+// expected to stop once ctx is cancelled. Both must finish within
+// shutdownTimeout.
+func Serve(ctx context.Context, app *fiber.App, addr string, shutdownTimeout time.Duration, workers *sync.WaitGroup) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- app.Listen(addr)
+	}()
+
+	select {
+	case err := <-errCh:
+		// The listener failed on its own, e.g. the port is taken
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down", "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := app.ShutdownWithContext(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-shutdownCtx.Done():
+		return errors.New("background workers did not stop before the shutdown timeout")
+	}
+}
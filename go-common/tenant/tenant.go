@@ -0,0 +1,147 @@
+// Package tenant resolves which of the customer apps sharing a deployment a
+// request belongs to. Users, their lookups and their tokens are scoped by
+// tenant, so the same username or email can exist once per tenant.
+package tenant
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/gofiber/fiber/v2"
+)
+
+// DefaultID is the tenant of requests that name none, and of all rows
+// written before tenants existed
+const DefaultID = "default"
+
+// Tenant is a tenant with its settings, in which empty settings have been
+// filled in from the service's
+type Tenant struct {
+	ID string
+	config.Tenant
+}
+
+// Key scopes key, e.g. a rate limit key, to the tenant in tables shared by
+// all tenants
+func (t *Tenant) Key(key string) string {
+	return t.ID + "/" + key
+}
+
+// Registry holds the configured tenants
+type Registry struct {
+	header string
+	byID   map[string]*Tenant
+	byHost map[string]*Tenant
+}
+
+// NewRegistry returns the tenants of tenancy, plus the default tenant if it
+// is not listed. Settings a tenant leaves empty are taken from defaults.
+func NewRegistry(tenancy config.Tenancy, defaults config.Tenant) *Registry {
+	r := &Registry{
+		header: tenancy.Header,
+		byID:   make(map[string]*Tenant),
+		byHost: make(map[string]*Tenant),
+	}
+	settings := tenancy.Tenants
+	if _, ok := settings[DefaultID]; !ok {
+		settings = make(map[string]config.Tenant, len(tenancy.Tenants)+1)
+		for id, s := range tenancy.Tenants {
+			settings[id] = s
+		}
+		settings[DefaultID] = config.Tenant{}
+	}
+
+	for id, s := range settings {
+		t := &Tenant{ID: id, Tenant: s}
+		if t.Issuer == "" {
+			t.Issuer = id
+		}
+		if t.JWTSecret == "" {
+			t.JWTSecret = defaults.JWTSecret
+		}
+		if t.PublicURL == "" {
+			t.PublicURL = defaults.PublicURL
+		}
+		if t.SenderEmail == "" {
+			t.SenderEmail = defaults.SenderEmail
+		}
+		if t.PasswordMinLength == 0 {
+			t.PasswordMinLength = defaults.PasswordMinLength
+		}
+		r.byID[id] = t
+		for _, host := range s.Hosts {
+			r.byHost[strings.ToLower(host)] = t
+		}
+	}
+	return r
+}
+
+// Get returns the tenant with id; rows without a tenant belong to the
+// default tenant
+func (r *Registry) Get(id string) (*Tenant, bool) {
+	t, ok := r.byID[Stored(id)]
+	return t, ok
+}
+
+// All returns every configured tenant, ordered by ID
+func (r *Registry) All() []*Tenant {
+	all := make([]*Tenant, 0, len(r.byID))
+	for _, t := range r.byID {
+		all = append(all, t)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+// Middleware stores the tenant of each request in its user context, see
+// FromContext. Requests naming an unknown tenant in the header are rejected.
+func (r *Registry) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		t, ok := r.byHost[strings.ToLower(hostname(c.Hostname()))]
+		if !ok {
+			id := c.Get(r.header)
+			if id == "" {
+				id = DefaultID
+			}
+			if t, ok = r.byID[id]; !ok {
+				return response.New(response.CodeTenantUnknown, "Unknown tenant")
+			}
+		}
+		c.SetUserContext(NewContext(c.UserContext(), t))
+		return c.Next()
+	}
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying t
+func NewContext(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the tenant stored by Middleware or NewContext, or nil
+func FromContext(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(contextKey{}).(*Tenant)
+	return t
+}
+
+// Stored returns the tenant a row belongs to given its tenant column, which
+// is empty for rows written before tenants existed
+func Stored(id string) string {
+	if id == "" {
+		return DefaultID
+	}
+	return id
+}
+
+// hostname strips the port from a Host header
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,40 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/cassandra"
+	"github.com/gocql/gocql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CassandraObserver implements gocql.QueryObserver and gocql.BatchObserver,
+// recording a client span for every query under the span in the query's
+// context (see gocql.Query.WithContext)
+type CassandraObserver struct{}
+
+func (CassandraObserver) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	operation, table := cassandra.DescribeStatement(q.Statement)
+	_, span := Tracer().Start(ctx, "cassandra "+operation+" "+table,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(q.Start),
+		trace.WithAttributes(
+			semconv.DBSystemCassandra,
+			semconv.DBNamespace(q.Keyspace),
+			semconv.DBOperationName(operation),
+			semconv.DBCollectionName(table),
+			semconv.DBQueryText(q.Statement),
+		),
+	)
+	End(span, q.Err, trace.WithTimestamp(q.End))
+}
+
+func (CassandraObserver) ObserveBatch(ctx context.Context, b gocql.ObservedBatch) {
+	_, span := Tracer().Start(ctx, "cassandra BATCH",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(b.Start),
+		trace.WithAttributes(semconv.DBSystemCassandra, semconv.DBNamespace(b.Keyspace)),
+	)
+	End(span, b.Err, trace.WithTimestamp(b.End))
+}
@@ -0,0 +1,82 @@
+// Package userstatus defines the statuses an account can be in. Only active
+// accounts can sign in, refresh their tokens or use their API keys.
+// Suspensions and bans may be given an end, after which the account is
+// active again without anyone lifting them.
+package userstatus
+
+import (
+	"context"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/gocql/gocql"
+)
+
+// Status is the status of an account
+type Status string
+
+const (
+	Active    Status = "active"
+	Suspended Status = "suspended"
+	Banned    Status = "banned"
+	// Pending accounts wait for an admin to let them in
+	Pending Status = "pending"
+)
+
+// Statuses lists every status an account can be given
+var Statuses = []Status{Active, Suspended, Banned, Pending}
+
+// Known reports whether s is one of Statuses
+func Known(s Status) bool {
+	for _, known := range Statuses {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Expires reports whether accounts in status s can be given an end
+func Expires(s Status) bool {
+	return s == Suspended || s == Banned
+}
+
+// Effective returns the status in force at now of an account with the
+// stored status and end. Accounts without a status are active, and so are
+// accounts whose suspension or ban ended.
+func Effective(stored string, until, now time.Time) Status {
+	s := Status(stored)
+	if s == "" || (Expires(s) && !until.IsZero() && !now.Before(until)) {
+		return Active
+	}
+	return s
+}
+
+// Load returns the status in force of userID, or gocql.ErrNotFound
+func Load(ctx context.Context, session *gocql.Session, userID gocql.UUID) (Status, error) {
+	var (
+		stored string
+		until  time.Time
+	)
+	err := session.Query(`SELECT status, status_until FROM users WHERE id = ?`, userID).WithContext(ctx).Scan(&stored, &until)
+	if err != nil {
+		return "", err
+	}
+	return Effective(stored, until, time.Now()), nil
+}
+
+// Error returns an error ready to be returned by a handler for an account
+// in status s, or nil if s is Active
+func Error(s Status) error {
+	switch s {
+	case Active:
+		return nil
+	case Suspended:
+		return response.New(response.CodeAccountSuspended, "Account is suspended")
+	case Banned:
+		return response.New(response.CodeAccountBanned, "Account is banned")
+	case Pending:
+		return response.New(response.CodeAccountPending, "Account is pending approval")
+	}
+	return response.New(response.CodeForbidden, "Account is disabled")
+}
@@ -0,0 +1,164 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+)
+
+// Dispatcher delivers published events to the matching subscriptions of the
+// tenant they were published in, in the background. Events are queued in
+// memory, so deliveries still pending when the service stops are lost; the
+// delivery log shows how far they got.
+type Dispatcher struct {
+	Store
+	cfg    config.Webhooks
+	client *http.Client
+	queue  chan Payload
+}
+
+// NewDispatcher returns a Dispatcher; call Run to start delivering
+func NewDispatcher(session *gocql.Session, cfg config.Webhooks) *Dispatcher {
+	return &Dispatcher{
+		Store:  Store{Session: session},
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan Payload, cfg.QueueSize),
+	}
+}
+
+// Publish queues an event with data as its payload. It never blocks the
+// caller: when the queue is full the event is dropped and logged.
+func (d *Dispatcher) Publish(ctx context.Context, eventType EventType, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encoding webhook payload", "event", eventType, "error", err)
+		return
+	}
+	payload := Payload{ID: gocql.TimeUUID(), Type: eventType, CreatedAt: time.Now().UTC(), Data: raw}
+	if t := tenant.FromContext(ctx); t != nil {
+		payload.Tenant = t.ID
+	}
+	select {
+	case d.queue <- payload:
+	default:
+		metrics.WebhookDeliveries.WithLabelValues(string(eventType), "dropped").Inc()
+		slog.ErrorContext(ctx, "Webhook queue is full, dropping event", "event", eventType, "event_id", payload.ID)
+	}
+}
+
+// Run delivers queued events until ctx is done, then waits for the
+// deliveries in progress to give up
+func (d *Dispatcher) Run(ctx context.Context) {
+	var deliveries sync.WaitGroup
+	defer deliveries.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-d.queue:
+			// Each tenant only hears about its own users
+			subs, err := d.Subscriptions(ctx, payload.Tenant)
+			if err != nil {
+				slog.Error("Error loading webhook subscriptions", "event", payload.Type, "event_id", payload.ID, "error", err)
+				continue
+			}
+			body, err := json.Marshal(payload)
+			if err != nil {
+				slog.Error("Error encoding webhook payload", "event", payload.Type, "error", err)
+				continue
+			}
+			for _, sub := range subs {
+				if !sub.Wants(payload.Type) {
+					continue
+				}
+				deliveries.Add(1)
+				go func(sub Subscription) {
+					defer deliveries.Done()
+					d.deliver(ctx, sub, payload, body)
+				}(sub)
+			}
+		}
+	}
+}
+
+// deliver posts body to sub, retrying with exponential backoff until the
+// endpoint answers 2xx or MaxAttempts is reached
+func (d *Dispatcher) deliver(ctx context.Context, sub Subscription, payload Payload, body []byte) {
+	wait := d.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := d.post(ctx, sub, payload, body, attempt)
+		if err == nil {
+			metrics.WebhookDeliveries.WithLabelValues(string(payload.Type), "delivered").Inc()
+			return
+		}
+		if attempt >= d.cfg.MaxAttempts {
+			metrics.WebhookDeliveries.WithLabelValues(string(payload.Type), "failed").Inc()
+			slog.Error("Giving up on webhook delivery", "subscription_id", sub.ID, "event_id", payload.ID,
+				"attempts", attempt, "status", status, "error", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// post makes one delivery attempt and records it in the delivery log
+func (d *Dispatcher) post(ctx context.Context, sub Subscription, payload Payload, body []byte, attempt int) (int, error) {
+	start := time.Now()
+	status, err := d.send(ctx, sub, payload, body)
+	a := Attempt{
+		ID:         gocql.TimeUUID(),
+		EventID:    payload.ID,
+		EventType:  payload.Type,
+		Attempt:    attempt,
+		StatusCode: status,
+		DurationMS: int(time.Since(start).Milliseconds()),
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	// The log is written even while shutting down, so it reflects the last attempt
+	if logErr := d.logAttempt(context.WithoutCancel(ctx), sub.ID, a); logErr != nil {
+		slog.Error("Error logging webhook delivery", "subscription_id", sub.ID, "error", logErr)
+	}
+	return status, err
+}
+
+func (d *Dispatcher) send(ctx context.Context, sub Subscription, payload Payload, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, payload.ID.String())
+	req.Header.Set(HeaderEvent, string(payload.Type))
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, time.Now(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
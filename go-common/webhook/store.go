@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/auth"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+)
+
+var (
+	// ErrInvalidSubscription is returned for subscriptions with a bad URL or
+	// event list, along with the reasons below
+	ErrInvalidSubscription = errors.New("webhook: invalid subscription")
+	ErrURLInvalid          = errors.New("url must be an absolute http or https URL")
+	ErrEventsRequired      = errors.New("at least one event is required")
+	ErrEventUnknown        = errors.New("events must be known event types")
+	// ErrNotFound is returned for subscriptions the tenant does not have
+	ErrNotFound = errors.New("webhook: subscription not found")
+)
+
+// Subscription is an endpoint receiving a set of event types of its tenant
+type Subscription struct {
+	ID        gocql.UUID  `json:"id"`
+	Tenant    string      `json:"-"`
+	URL       string      `json:"url"`
+	Secret    string      `json:"secret,omitempty"`
+	Events    []EventType `json:"events"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// Wants reports whether s is subscribed to t
+func (s Subscription) Wants(t EventType) bool {
+	for _, e := range s.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Attempt is one entry of a subscription's delivery log
+type Attempt struct {
+	ID         gocql.UUID `json:"id"`
+	EventID    gocql.UUID `json:"event_id"`
+	EventType  EventType  `json:"event_type"`
+	Attempt    int        `json:"attempt"`
+	StatusCode int        `json:"status_code,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	DurationMS int        `json:"duration_ms"`
+	Time       time.Time  `json:"time"`
+}
+
+// Store keeps subscriptions and delivery logs in Cassandra
+type Store struct {
+	Session *gocql.Session
+}
+
+// Subscribe registers rawURL for the events of tenantID and returns the
+// subscription, including the generated signing secret
+func (s *Store) Subscribe(ctx context.Context, tenantID, rawURL string, events []EventType) (Subscription, error) {
+	var reasons []error
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		reasons = append(reasons, ErrURLInvalid)
+	}
+	if len(events) == 0 {
+		reasons = append(reasons, ErrEventsRequired)
+	}
+	names := make([]string, len(events))
+	for i, e := range events {
+		if !Known(e) {
+			reasons = append(reasons, ErrEventUnknown)
+			break
+		}
+		names[i] = string(e)
+	}
+	if len(reasons) > 0 {
+		return Subscription{}, fmt.Errorf("%w: %w", ErrInvalidSubscription, errors.Join(reasons...))
+	}
+
+	secret, err := auth.GenerateHexRandomToken(64)
+	if err != nil {
+		return Subscription{}, err
+	}
+	sub := Subscription{
+		ID:        gocql.TimeUUID(),
+		Tenant:    tenantID,
+		URL:       u.String(),
+		Secret:    secret,
+		Events:    events,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = s.Session.Query(`INSERT INTO webhook_subscriptions (id, tenant, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		sub.ID, sub.Tenant, sub.URL, sub.Secret, names, sub.CreatedAt).WithContext(ctx).Exec()
+	if err != nil {
+		return Subscription{}, err
+	}
+	return sub, nil
+}
+
+// Unsubscribe removes the subscription id of tenantID. Its delivery log
+// expires on its own.
+func (s *Store) Unsubscribe(ctx context.Context, tenantID string, id gocql.UUID) error {
+	if err := s.owned(ctx, tenantID, id); err != nil {
+		return err
+	}
+	return s.Session.Query(`DELETE FROM webhook_subscriptions WHERE id = ?`, id).WithContext(ctx).Exec()
+}
+
+// Subscriptions returns the subscriptions of tenantID, secrets included
+func (s *Store) Subscriptions(ctx context.Context, tenantID string) ([]Subscription, error) {
+	var subs []Subscription
+	var sub Subscription
+	var names []string
+	iter := s.Session.Query(`SELECT id, tenant, url, secret, events, created_at FROM webhook_subscriptions`).WithContext(ctx).Iter()
+	for iter.Scan(&sub.ID, &sub.Tenant, &sub.URL, &sub.Secret, &names, &sub.CreatedAt) {
+		sub.Tenant = tenant.Stored(sub.Tenant)
+		if sub.Tenant == tenant.Stored(tenantID) {
+			for _, name := range names {
+				sub.Events = append(sub.Events, EventType(name))
+			}
+			subs = append(subs, sub)
+		}
+		sub, names = Subscription{}, nil
+	}
+	return subs, iter.Close()
+}
+
+// Deliveries returns up to limit of the most recent delivery attempts of
+// the subscription id of tenantID
+func (s *Store) Deliveries(ctx context.Context, tenantID string, id gocql.UUID, limit int) ([]Attempt, error) {
+	if err := s.owned(ctx, tenantID, id); err != nil {
+		return nil, err
+	}
+	var attempts []Attempt
+	var a Attempt
+	var eventType string
+	iter := s.Session.Query(`SELECT attempt_id, event_id, event_type, attempt, status_code, error, duration_ms
+        FROM webhook_deliveries WHERE subscription_id = ? LIMIT ?`, id, limit).WithContext(ctx).Iter()
+	for iter.Scan(&a.ID, &a.EventID, &eventType, &a.Attempt, &a.StatusCode, &a.Error, &a.DurationMS) {
+		a.EventType = EventType(eventType)
+		a.Time = a.ID.Time()
+		attempts = append(attempts, a)
+		a = Attempt{}
+	}
+	return attempts, iter.Close()
+}
+
+// owned returns ErrNotFound unless the subscription id belongs to tenantID
+func (s *Store) owned(ctx context.Context, tenantID string, id gocql.UUID) error {
+	var owner string
+	err := s.Session.Query(`SELECT tenant FROM webhook_subscriptions WHERE id = ?`, id).WithContext(ctx).Scan(&owner)
+	if err == gocql.ErrNotFound || (err == nil && tenant.Stored(owner) != tenant.Stored(tenantID)) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *Store) logAttempt(ctx context.Context, subscriptionID gocql.UUID, a Attempt) error {
+	return s.Session.Query(`INSERT INTO webhook_deliveries (subscription_id, attempt_id, event_id, event_type, attempt, status_code, error, duration_ms)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		subscriptionID, a.ID, a.EventID, string(a.EventType), a.Attempt, a.StatusCode, a.Error, a.DurationMS).WithContext(ctx).Exec()
+}
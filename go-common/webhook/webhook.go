@@ -0,0 +1,112 @@
+// Package webhook delivers signed user lifecycle events to subscribed HTTP
+// endpoints.
+//
+// Every delivery is a POST of a JSON Payload with these headers:
+//
+//	X-Webhook-Id:        the event ID, identical across retries
+//	X-Webhook-Event:     the event type, e.g. user.registered
+//	X-Webhook-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256>
+//
+// The signature is computed with the subscription secret over
+// "<unix seconds>.<body>". Receivers should check it with Verify and reject
+// timestamps outside a small tolerance to prevent replays.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// EventType names a user lifecycle event
+type EventType string
+
+const (
+	UserRegistered    EventType = "user.registered"
+	UserEmailVerified EventType = "user.email_verified"
+	UserPasswordReset EventType = "user.password_reset"
+	UserDeleted       EventType = "user.deleted"
+	SessionRevoked    EventType = "session.revoked"
+)
+
+// EventTypes lists every event that can be subscribed to
+var EventTypes = []EventType{UserRegistered, UserEmailVerified, UserPasswordReset, UserDeleted, SessionRevoked}
+
+// Known reports whether t is one of EventTypes
+func Known(t EventType) bool {
+	for _, known := range EventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload is the body of a delivery. Tenant is the tenant of the user the
+// event is about.
+type Payload struct {
+	ID        gocql.UUID      `json:"id"`
+	Type      EventType       `json:"type"`
+	Tenant    string          `json:"tenant,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Headers set on every delivery
+const (
+	HeaderID        = "X-Webhook-Id"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+var (
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	ErrStaleSignature   = errors.New("webhook: signature timestamp outside tolerance")
+)
+
+// Sign returns the X-Webhook-Signature value for body sent at ts
+func Sign(secret string, ts time.Time, body []byte) string {
+	unix := strconv.FormatInt(ts.Unix(), 10)
+	return "t=" + unix + ",v1=" + mac(secret, unix, body)
+}
+
+// Verify checks an X-Webhook-Signature header against body, rejecting
+// signatures older or newer than tolerance
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	var unix, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			unix = value
+		case "v1":
+			signature = value
+		}
+	}
+	sec, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil || signature == "" {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+		return ErrStaleSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(mac(secret, unix, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func mac(secret, unix string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(unix))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
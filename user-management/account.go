@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/caller"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/userstatus"
+	"github.com/bdobrica/LLMDesignedApp/go-common/webhook"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
+)
+
+// Users delete their account with DELETE /me, which schedules the deletion
+// cfg.Accounts.DeletionGracePeriod ahead. Until the sweeper carries it out
+// the account keeps working and the deletion can be cancelled. Admins delete
+// accounts right away. Either way everything held about the user is removed
+// and their audit events are pseudonymized, see deleteAccount.
+
+// Account is what deleting or exporting an account starts from
+type Account struct {
+	ID                  gocql.UUID
+	Tenant              string
+	Username            string
+	Email               string
+	Locale              string
+	CreatedAt           time.Time
+	DeletionScheduledAt time.Time
+}
+
+// since returns when the account was created. Accounts created before that
+// was recorded fall back to the time in their ID.
+func (a Account) since() time.Time {
+	if a.CreatedAt.IsZero() {
+		return a.ID.Time()
+	}
+	return a.CreatedAt
+}
+
+// requestDeletion schedules the deletion of the caller's account. API keys
+// cannot do so, so that a leaked key cannot be used to delete the account.
+func requestDeletion(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	user := caller.From(c)
+	if user.Key != nil {
+		return response.New(response.CodeForbidden, "API keys cannot delete accounts")
+	}
+	account, err := loadAccount(ctx, user.UserID)
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error scheduling account deletion")
+	}
+	if !account.DeletionScheduledAt.IsZero() {
+		return response.Success(c, fiber.StatusAccepted, "Account deletion scheduled", fiber.Map{"deletion_scheduled_at": account.DeletionScheduledAt})
+	}
+
+	// Organizations shared with others must keep an owner
+	memberships, err := listMemberships(ctx, user.UserID)
+	if err != nil {
+		return response.Internal(err, "Error scheduling account deletion")
+	}
+	for _, membership := range memberships {
+		if membership.Role != roleOwner {
+			continue
+		}
+		members, err := listMembers(ctx, membership.ID)
+		if err != nil {
+			return response.Internal(err, "Error scheduling account deletion")
+		}
+		if len(members) > 1 {
+			if err := ensureAnotherOwner(ctx, membership.ID, user.UserID); err != nil {
+				return err
+			}
+		}
+	}
+
+	scheduledAt := time.Now().Add(cfg.Accounts.DeletionGracePeriod)
+	if err := session.Query(`UPDATE users SET deletion_scheduled_at = ? WHERE id = ?`, scheduledAt, user.UserID).WithContext(ctx).Exec(); err != nil {
+		return response.Internal(err, "Error scheduling account deletion")
+	}
+
+	// The notice warns users whose session was taken over; the deletion
+	// stands even if it cannot be sent
+	tag, ok := i18n.Parse(account.Locale)
+	if !ok {
+		tag = i18n.Locale(c)
+	}
+	if err := sendDeletionEmail(ctx, account.Email, scheduledAt, tag); err != nil {
+		logging.FromCtx(c).Error("Error sending account deletion notice", "user_id", user.UserID, "error", err)
+	}
+
+	event := audit.FromRequest(c, audit.DeletionRequested, user.UserID)
+	event.Details = map[string]string{"scheduled_at": scheduledAt.UTC().Format(time.RFC3339)}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusAccepted, "Account deletion scheduled", fiber.Map{"deletion_scheduled_at": scheduledAt})
+}
+
+// cancelDeletion cancels the scheduled deletion of the caller's account
+func cancelDeletion(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	user := caller.From(c)
+	account, err := loadAccount(ctx, user.UserID)
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error cancelling account deletion")
+	}
+	if account.DeletionScheduledAt.IsZero() {
+		return response.New(response.CodeNotFound, "No account deletion is scheduled")
+	}
+
+	if err := session.Query(`UPDATE users SET deletion_scheduled_at = null WHERE id = ?`, user.UserID).WithContext(ctx).Exec(); err != nil {
+		return response.Internal(err, "Error cancelling account deletion")
+	}
+
+	auditLog.Record(ctx, audit.FromRequest(c, audit.DeletionCancelled, user.UserID))
+	return response.Success(c, fiber.StatusOK, "Account deletion cancelled", nil)
+}
+
+// deleteUserAccount deletes an account of the tenant of the request right away
+func deleteUserAccount(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	userID, err := gocql.ParseUUID(c.Params("user_id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid user ID")
+	}
+	account, err := loadAccount(ctx, userID)
+	if err == nil && account.Tenant != tenant.FromContext(ctx).ID {
+		err = gocql.ErrNotFound
+	}
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error deleting account")
+	}
+
+	if err := deleteAccount(ctx, account, audit.ActorAdmin, "admin"); err != nil {
+		return response.Internal(err, "Error deleting account")
+	}
+
+	logging.FromCtx(c).Info("Account deleted", "user_id", userID)
+	return response.Success(c, fiber.StatusOK, "Account deleted", nil)
+}
+
+// statusReasonMaxLength bounds the reasons given for account statuses
+const statusReasonMaxLength = 500
+
+// StatusRequest is the body accepted when changing the status of an account
+type StatusRequest struct {
+	Status userstatus.Status `json:"status"`
+	Reason string            `json:"reason"`
+	// Until is optional; suspensions and bans without it last until lifted
+	Until *time.Time `json:"until"`
+}
+
+// AccountStatus is the status of an account as stored, with its reason and end
+type AccountStatus struct {
+	Status userstatus.Status `json:"status"`
+	Reason string            `json:"reason,omitempty"`
+	Until  *time.Time        `json:"until,omitempty"`
+}
+
+// getUserStatus returns the status of an account of the tenant of the
+// request. Suspensions and bans that ended are reported as active.
+func getUserStatus(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	userID, err := gocql.ParseUUID(c.Params("user_id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid user ID")
+	}
+	var (
+		tenantID string
+		stored   string
+		reason   string
+		until    time.Time
+	)
+	err = session.Query(`SELECT tenant, status, status_reason, status_until FROM users WHERE id = ?`, userID).WithContext(ctx).
+		Scan(&tenantID, &stored, &reason, &until)
+	if err == nil && tenant.Stored(tenantID) != tenant.FromContext(ctx).ID {
+		err = gocql.ErrNotFound
+	}
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error retrieving user")
+	}
+
+	status := AccountStatus{Status: userstatus.Effective(stored, until, time.Now())}
+	if status.Status != userstatus.Active {
+		status.Reason = reason
+		if !until.IsZero() {
+			status.Until = &until
+		}
+	}
+	return response.Success(c, fiber.StatusOK, "", status)
+}
+
+// setUserStatus changes the status of an account of the tenant of the
+// request. Accounts that are not active lose their sessions right away.
+func setUserStatus(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	userID, err := gocql.ParseUUID(c.Params("user_id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid user ID")
+	}
+	request := new(StatusRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+
+	var fields []response.FieldError
+	if !userstatus.Known(request.Status) {
+		fields = append(fields, response.FieldError{Field: "status", Code: response.CodeFieldNotAllowed, Message: "status must be active, suspended, banned or pending"})
+	}
+	request.Reason = strings.TrimSpace(request.Reason)
+	if len([]rune(request.Reason)) > statusReasonMaxLength {
+		fields = append(fields, response.FieldError{Field: "reason", Code: response.CodeFieldOutOfRange, Message: "reason must be at most 500 characters"})
+	}
+	if request.Until != nil && !userstatus.Expires(request.Status) {
+		fields = append(fields, response.FieldError{Field: "until", Code: response.CodeFieldNotAllowed, Message: "only suspensions and bans can end"})
+	} else if request.Until != nil && !request.Until.After(time.Now()) {
+		fields = append(fields, response.FieldError{Field: "until", Code: response.CodeFieldOutOfRange, Message: "until must be in the future"})
+	}
+	if len(fields) > 0 {
+		return response.Invalid(fields...)
+	}
+
+	account, err := loadAccount(ctx, userID)
+	if err == nil && account.Tenant != tenant.FromContext(ctx).ID {
+		err = gocql.ErrNotFound
+	}
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error updating account status")
+	}
+
+	var reason *string
+	if request.Reason != "" {
+		reason = &request.Reason
+	}
+	err = session.Query(`UPDATE users SET status = ?, status_reason = ?, status_until = ? WHERE id = ?`,
+		string(request.Status), reason, request.Until, userID).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error updating account status")
+	}
+	if request.Status != userstatus.Active {
+		if err := revokeSessions(ctx, userID); err != nil {
+			return response.Internal(err, "Error revoking sessions")
+		}
+		webhooks.Publish(ctx, webhook.SessionRevoked, fiber.Map{"user_id": userID, "reason": string(request.Status)})
+	}
+
+	event := audit.FromRequest(c, audit.StatusChanged, userID)
+	event.Actor = audit.ActorAdmin
+	event.Details = map[string]string{"status": string(request.Status)}
+	if request.Reason != "" {
+		event.Details["reason"] = request.Reason
+	}
+	if request.Until != nil {
+		event.Details["until"] = request.Until.UTC().Format(time.RFC3339)
+	}
+	auditLog.Record(ctx, event)
+	logging.FromCtx(c).Info("Account status changed", "user_id", userID, "status", request.Status)
+	return response.Success(c, fiber.StatusOK, "", AccountStatus{Status: request.Status, Reason: request.Reason, Until: request.Until})
+}
+
+// deleteAccount deletes account and everything held about its user in the
+// tenant in ctx, and pseudonymizes their audit events along with the events
+// they recorded for others. Credentials go first
+// and the users row last, so that an account that was only partly deleted
+// can no longer be used and is found again by the next attempt.
+func deleteAccount(ctx context.Context, account Account, actor, reason string) error {
+	if err := revokeSessions(ctx, account.ID); err != nil {
+		return err
+	}
+	if err := apiKeys.RevokeAll(ctx, account.ID); err != nil {
+		return err
+	}
+	if err := unlinkIdentities(ctx, account.ID); err != nil {
+		return err
+	}
+	if err := leaveOrganizations(ctx, account.ID); err != nil {
+		return err
+	}
+	if err := session.Query(`DELETE FROM user_exports WHERE user_id = ?`, account.ID).WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	pseudonym, err := gocql.RandomUUID()
+	if err != nil {
+		return err
+	}
+	if err := auditLog.Pseudonymize(ctx, account.ID, pseudonym, account.since()); err != nil {
+		return err
+	}
+	if err := session.Query(`DELETE FROM users WHERE id = ?`, account.ID).WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	releaseUsername(ctx, account.Username, account.ID)
+	releaseEmail(ctx, account.Email, account.ID)
+
+	auditLog.Record(ctx, audit.Event{
+		Type:    audit.AccountDeleted,
+		UserID:  pseudonym,
+		Actor:   actor,
+		Details: map[string]string{"reason": reason},
+	})
+	webhooks.Publish(ctx, webhook.UserDeleted, map[string]interface{}{"user_id": account.ID, "reason": reason})
+	return nil
+}
+
+// loadAccount returns the account of userID, or gocql.ErrNotFound
+func loadAccount(ctx context.Context, userID gocql.UUID) (Account, error) {
+	account := Account{ID: userID}
+	err := session.Query(`SELECT tenant, username, email, locale, created_at, deletion_scheduled_at FROM users WHERE id = ?`, userID).WithContext(ctx).
+		Scan(&account.Tenant, &account.Username, &account.Email, &account.Locale, &account.CreatedAt, &account.DeletionScheduledAt)
+	if err != nil {
+		return Account{}, err
+	}
+	account.Tenant = tenant.Stored(account.Tenant)
+	return account, nil
+}
+
+// revokeSessions revokes every refresh token of userID
+func revokeSessions(ctx context.Context, userID gocql.UUID) error {
+	var token string
+	iter := session.Query(`SELECT "token" FROM refresh_tokens_by_user WHERE user_id = ?`, userID).WithContext(ctx).Iter()
+	for iter.Scan(&token) {
+		if err := session.Query(`DELETE FROM refresh_tokens WHERE "token" = ?`, token).WithContext(ctx).Exec(); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return session.Query(`DELETE FROM refresh_tokens_by_user WHERE user_id = ?`, userID).WithContext(ctx).Exec()
+}
+
+// unlinkIdentities removes the links of userID to external identities in the
+// tenant in ctx
+func unlinkIdentities(ctx context.Context, userID gocql.UUID) error {
+	var provider, subject string
+	iter := session.Query(`SELECT provider, subject FROM user_identities_by_user WHERE user_id = ?`, userID).WithContext(ctx).Iter()
+	for iter.Scan(&provider, &subject) {
+		err := session.Query(`DELETE FROM tenant_user_identities WHERE tenant = ? AND provider = ? AND subject = ?`,
+			tenant.FromContext(ctx).ID, provider, subject).WithContext(ctx).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return session.Query(`DELETE FROM user_identities_by_user WHERE user_id = ?`, userID).WithContext(ctx).Exec()
+}
+
+// leaveOrganizations ends the memberships of userID. Organizations left
+// without members are deleted, and those left without an owner are handed
+// to the most senior of the remaining members.
+func leaveOrganizations(ctx context.Context, userID gocql.UUID) error {
+	memberships, err := listMemberships(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, membership := range memberships {
+		members, err := listMembers(ctx, membership.ID)
+		if err != nil {
+			return err
+		}
+		var (
+			successor *Member
+			owned     bool
+		)
+		for i, member := range members {
+			if member.UserID == userID {
+				continue
+			}
+			owned = owned || member.Role == roleOwner
+			if successor == nil || roleRank[member.Role] > roleRank[successor.Role] ||
+				(member.Role == successor.Role && member.JoinedAt.Before(successor.JoinedAt)) {
+				successor = &members[i]
+			}
+		}
+		if successor == nil {
+			if err := dissolveOrganization(ctx, membership.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if !owned {
+			if err := setMemberRole(ctx, membership.ID, successor.UserID, roleOwner); err != nil {
+				return err
+			}
+		}
+		if err := removeMember(ctx, membership.ID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDeletionEmail tells a user in the language tag when their account will
+// be deleted
+func sendDeletionEmail(ctx context.Context, to string, scheduledAt time.Time, tag language.Tag) error {
+	subject := i18n.Translate(tag, "Your account is scheduled for deletion")
+	body := fmt.Sprintf(`
+        <h1>%s</h1>
+        <p>%s</p>
+    `, html.EscapeString(subject),
+		html.EscapeString(fmt.Sprintf(i18n.Translate(tag, "Your account will be deleted on %s. If you did not ask for this, sign in and cancel the deletion."), scheduledAt.UTC().Format("2006-01-02"))))
+
+	return mailer.Send(ctx, to, subject, body)
+}
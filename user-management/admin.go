@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/webhook"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// requireAdmin only lets requests carrying the admin API token through
+func requireAdmin(c *fiber.Ctx) error {
+	token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminAPIToken)) != 1 {
+		return response.New(response.CodeUnauthorized, "Unauthorized")
+	}
+	return c.Next()
+}
+
+// queryAuditEvents lists the audit events of a user of the tenant of the
+// request. The range is given by the RFC 3339 from and to query parameters
+// and defaults to the last 24 hours; type takes a comma separated list of
+// event types.
+func queryAuditEvents(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	userID, err := gocql.ParseUUID(c.Params("user_id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid user ID")
+	}
+	var tenantID string
+	err = session.Query(`SELECT tenant FROM users WHERE id = ?`, userID).WithContext(ctx).Scan(&tenantID)
+	if err == nil && tenant.Stored(tenantID) != tenant.FromContext(ctx).ID {
+		err = gocql.ErrNotFound
+	}
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeUserNotFound, "User not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error querying audit events")
+	}
+
+	to := time.Now()
+	if raw := c.Query("to"); raw != "" {
+		if to, err = time.Parse(time.RFC3339, raw); err != nil {
+			return response.New(response.CodeBadRequest, "Invalid to, expected an RFC 3339 timestamp")
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if raw := c.Query("from"); raw != "" {
+		if from, err = time.Parse(time.RFC3339, raw); err != nil {
+			return response.New(response.CodeBadRequest, "Invalid from, expected an RFC 3339 timestamp")
+		}
+	}
+	if to.Before(from) || to.Sub(from) > audit.MaxRange {
+		return response.New(response.CodeBadRequest, "Invalid range, from must precede to by at most 31 days")
+	}
+
+	var types []audit.EventType
+	for _, t := range strings.Split(c.Query("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, audit.EventType(t))
+		}
+	}
+
+	events, err := auditLog.Query(ctx, userID, from, to, types...)
+	if err != nil {
+		return response.Internal(err, "Error querying audit events")
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+
+	return response.Success(c, fiber.StatusOK, "", events)
+}
+
+// WebhookRequest is the body accepted when creating a webhook subscription
+type WebhookRequest struct {
+	URL    string              `json:"url"`
+	Events []webhook.EventType `json:"events"`
+}
+
+// createWebhook subscribes a URL to events of the tenant of the request. The
+// signing secret is only ever returned here.
+func createWebhook(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	request := new(WebhookRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+
+	sub, err := webhooks.Subscribe(ctx, tenant.FromContext(ctx).ID, request.URL, request.Events)
+	if errors.Is(err, webhook.ErrInvalidSubscription) {
+		return response.Invalid(webhookFields(err)...)
+	}
+	if err != nil {
+		return response.Internal(err, "Error creating webhook subscription")
+	}
+
+	logging.FromCtx(c).Info("Webhook subscription created", "subscription_id", sub.ID, "url", sub.URL)
+	return response.Success(c, fiber.StatusCreated, "", sub)
+}
+
+// webhookFields reports the reasons a subscription was refused per field
+func webhookFields(err error) []response.FieldError {
+	var fields []response.FieldError
+	if errors.Is(err, webhook.ErrURLInvalid) {
+		fields = append(fields, response.FieldError{Field: "url", Code: response.CodeFieldFormat, Message: webhook.ErrURLInvalid.Error()})
+	}
+	if errors.Is(err, webhook.ErrEventsRequired) {
+		fields = append(fields, response.FieldError{Field: "events", Code: response.CodeFieldRequired, Message: webhook.ErrEventsRequired.Error()})
+	}
+	if errors.Is(err, webhook.ErrEventUnknown) {
+		fields = append(fields, response.FieldError{Field: "events", Code: response.CodeFieldNotAllowed, Message: webhook.ErrEventUnknown.Error()})
+	}
+	return fields
+}
+
+// listWebhooks lists the subscriptions of the tenant of the request without
+// their secrets
+func listWebhooks(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	subs, err := webhooks.Subscriptions(ctx, tenant.FromContext(ctx).ID)
+	if err != nil {
+		return response.Internal(err, "Error listing webhook subscriptions")
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	if subs == nil {
+		subs = []webhook.Subscription{}
+	}
+
+	return response.Success(c, fiber.StatusOK, "", subs)
+}
+
+// deleteWebhook removes a subscription of the tenant of the request
+func deleteWebhook(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid subscription ID")
+	}
+
+	err = webhooks.Unsubscribe(ctx, tenant.FromContext(ctx).ID, id)
+	if errors.Is(err, webhook.ErrNotFound) {
+		return response.New(response.CodeNotFound, "Webhook subscription not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error deleting webhook subscription")
+	}
+
+	return response.Success(c, fiber.StatusOK, "Webhook subscription deleted", nil)
+}
+
+// listWebhookDeliveries returns the most recent delivery attempts of a
+// subscription of the tenant of the request; limit defaults to 100
+func listWebhookDeliveries(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid subscription ID")
+	}
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > 1000 {
+		return response.New(response.CodeBadRequest, "Invalid limit, expected 1 to 1000")
+	}
+
+	attempts, err := webhooks.Deliveries(ctx, tenant.FromContext(ctx).ID, id, limit)
+	if errors.Is(err, webhook.ErrNotFound) {
+		return response.New(response.CodeNotFound, "Webhook subscription not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error listing webhook deliveries")
+	}
+	if attempts == nil {
+		attempts = []webhook.Attempt{}
+	}
+
+	return response.Success(c, fiber.StatusOK, "", attempts)
+}
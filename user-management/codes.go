@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/emailcode"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/webhook"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Codes are the alternative to the links of /verify and /reset for native
+// apps: the app asks for a code to be emailed with .../code/request and sends
+// it back with the address to .../code. Code requests are answered the same
+// whether or not the address belongs to an account.
+
+// codeSent is the answer to every well-formed code request
+const codeSent = "If the address belongs to an account, a code has been sent to it"
+
+// CodeRequest is the body accepted by the code request endpoints
+type CodeRequest struct {
+	Email string `json:"email"`
+}
+
+// CodeConfirmation is the body accepted by /verify/code
+type CodeConfirmation struct {
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+// CodeResetRequest is the body accepted by /recover/code
+type CodeResetRequest struct {
+	Email    string `json:"email"`
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+// requestVerificationCode emails a code that verifies an unverified address
+func requestVerificationCode(c *fiber.Ctx) error {
+	return sendEmailCode(c, emailcode.VerifyEmail)
+}
+
+// requestResetCode emails a code that allows resetting the password
+func requestResetCode(c *fiber.Ctx) error {
+	return sendEmailCode(c, emailcode.ResetPassword)
+}
+
+// sendEmailCode emails a code for purpose to the owner of the address in the request
+func sendEmailCode(c *fiber.Ctx, purpose emailcode.Purpose) error {
+	ctx := c.UserContext()
+	request := new(CodeRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	email, err := identity.NormalizeEmail(request.Email)
+	if err != nil {
+		return response.Invalid(response.Field("email", err))
+	}
+
+	// Limit the codes sent to an address, whether or not it has an account
+	t := tenant.FromContext(ctx)
+	allowed, err := emailCodeLimiter.Allow(ctx, t.Key(identity.EmailKey(email)))
+	if err != nil {
+		return response.Internal(err, "Error sending code")
+	}
+	if !allowed {
+		metrics.Outcome(metrics.OutcomeRateLimited)
+		return response.New(response.CodeRateLimited, "Too many requests, please try again later")
+	}
+
+	var user User
+	var locale string
+	userID, err := lookupUserIDByEmail(ctx, email)
+	if err == nil {
+		err = session.Query(`SELECT id, email, email_verified, locale FROM users WHERE id = ?`, userID).WithContext(ctx).
+			Scan(&user.ID, &user.Email, &user.EmailVerified, &locale)
+	}
+	if err == gocql.ErrNotFound {
+		return response.Success(c, fiber.StatusAccepted, codeSent, nil)
+	}
+	if err != nil {
+		return response.Internal(err, "Error sending code")
+	}
+	// There is nothing left to verify
+	if purpose == emailcode.VerifyEmail && user.EmailVerified {
+		return response.Success(c, fiber.StatusAccepted, codeSent, nil)
+	}
+
+	code, err := emailCodes.Issue(ctx, t.ID, purpose, identity.EmailKey(email), user.ID)
+	if err != nil {
+		return response.Internal(err, "Error sending code")
+	}
+
+	// The email is written in the user's language, falling back to the request's
+	tag, ok := i18n.Parse(locale)
+	if !ok {
+		tag = i18n.Locale(c)
+	}
+	subject, body := emailCodes.Message(tag, purpose, code)
+	// A delivery failure is only logged; answering differently would reveal the account
+	if err := mailer.Send(ctx, user.Email, subject, body); err != nil {
+		logging.FromCtx(c).Error("Error sending code", "user_id", user.ID, "purpose", purpose, "error", err)
+	} else {
+		metrics.Outcome(metrics.OutcomeEmailCodeSent)
+		event := audit.FromRequest(c, audit.EmailCodeSent, user.ID)
+		event.Details = map[string]string{"purpose": string(purpose)}
+		auditLog.Record(ctx, event)
+	}
+
+	return response.Success(c, fiber.StatusAccepted, codeSent, nil)
+}
+
+// verifyEmailCode verifies an address with a code, like verifyEmail does with a link
+func verifyEmailCode(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	request := new(CodeConfirmation)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+
+	userID, err := checkEmailCode(ctx, emailcode.VerifyEmail, request.Email, request.Code)
+	if err != nil {
+		return err
+	}
+
+	var email string
+	if err := session.Query(`SELECT email FROM users WHERE id = ?`, userID).WithContext(ctx).Scan(&email); err != nil {
+		return response.Internal(err, "Error retrieving user")
+	}
+	if err := session.Query(`UPDATE users SET email_verified = true, verification_token = null, verification_token_expires_at = null WHERE id = ?`, userID).WithContext(ctx).Exec(); err != nil {
+		return response.Internal(err, "Error updating user verification status")
+	}
+
+	metrics.Outcome(metrics.OutcomeEmailVerified)
+	auditLog.Record(ctx, audit.FromRequest(c, audit.EmailVerified, userID))
+	webhooks.Publish(ctx, webhook.UserEmailVerified, fiber.Map{"user_id": userID, "email": email})
+	return response.Success(c, fiber.StatusOK, "Email successfully verified", nil)
+}
+
+// resetPasswordCode sets a new password with a code, like resetPassword does with a link
+func resetPasswordCode(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	request := new(CodeResetRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	// The password is checked first so that a weak one does not use up the code
+	if err := validatePassword(i18n.Locale(c), tenant.FromContext(ctx).PasswordMinLength, request.Password); err != nil {
+		return response.Invalid(response.Field("password", err))
+	}
+
+	userID, err := checkEmailCode(ctx, emailcode.ResetPassword, request.Email, request.Code)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(ctx, request.Password)
+	if err != nil {
+		return response.Internal(err, "Error hashing password")
+	}
+	err = session.Query(`UPDATE users SET password = ?, verification_token = null, verification_token_expires_at = null WHERE id = ?`, hashedPassword, userID).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error updating password")
+	}
+
+	metrics.Outcome(metrics.OutcomePasswordReset)
+	auditLog.Record(ctx, audit.FromRequest(c, audit.PasswordReset, userID))
+	webhooks.Publish(ctx, webhook.UserPasswordReset, fiber.Map{"user_id": userID})
+	return response.Success(c, fiber.StatusOK, "Password successfully reset", nil)
+}
+
+// checkEmailCode consumes the code for purpose and address and returns its
+// user. The returned error is ready to be returned by a handler.
+func checkEmailCode(ctx context.Context, purpose emailcode.Purpose, address, code string) (gocql.UUID, error) {
+	email, err := identity.NormalizeEmail(address)
+	if err != nil {
+		return gocql.UUID{}, response.Invalid(response.Field("email", err))
+	}
+
+	userID, err := emailCodes.Check(ctx, tenant.FromContext(ctx).ID, purpose, identity.EmailKey(email), code)
+	switch {
+	case errors.Is(err, emailcode.ErrInvalidCode):
+		metrics.Outcome(metrics.OutcomeEmailCodeBad)
+		return gocql.UUID{}, response.New(response.CodeCodeInvalid, "Invalid or expired code")
+	case errors.Is(err, emailcode.ErrTooManyAttempts):
+		metrics.Outcome(metrics.OutcomeEmailCodeBad)
+		return gocql.UUID{}, response.New(response.CodeCodeAttempts, "Too many attempts, please request a new code")
+	case err != nil:
+		return gocql.UUID{}, response.Internal(err, "Error checking code")
+	}
+	return userID, nil
+}
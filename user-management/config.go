@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+)
+
+// Config is the user-management configuration, see config.Load for its sources
+type Config struct {
+	HTTP      config.HTTP      `yaml:"http"`
+	Log       config.Log       `yaml:"log"`
+	Tracing   config.Tracing   `yaml:"tracing"`
+	Cassandra config.Cassandra `yaml:"cassandra"`
+	SMTP      config.SMTP      `yaml:"smtp"`
+	Sweeper   SweeperConfig    `yaml:"sweeper"`
+	Webhooks  config.Webhooks  `yaml:"webhooks"`
+	// EmailCodes configures the one-time verification and reset codes
+	EmailCodes config.EmailCodes `yaml:"email_codes"`
+	Tenancy    config.Tenancy    `yaml:"tenancy"`
+	// Registration configures how accounts are created
+	Registration RegistrationConfig `yaml:"registration"`
+	// Organizations configures organizations and their invitations
+	Organizations OrganizationsConfig `yaml:"organizations"`
+	// Accounts configures account deletion and data exports
+	Accounts AccountsConfig `yaml:"accounts"`
+
+	// PublicURL is the base URL used in links sent to users
+	PublicURL string `yaml:"public_url" env:"PUBLIC_URL" required:"true"`
+
+	// JWTSecret checks the access tokens issued by auth-service, which must
+	// use the same secret
+	JWTSecret string `yaml:"jwt_secret" env:"JWT_SECRET" required:"true"`
+
+	// AdminAPIToken is the bearer token for /admin routes, which are disabled when it is empty
+	AdminAPIToken string `yaml:"admin_api_token" env:"ADMIN_API_TOKEN"`
+}
+
+// RegistrationConfig configures how accounts are created
+type RegistrationConfig struct {
+	// Open lets anyone register; otherwise accounts are only created from
+	// invitations sent by admins
+	Open bool `yaml:"open" env:"REGISTRATION_OPEN"`
+	// InvitationTTL is how long an invitation to register can be used
+	InvitationTTL time.Duration `yaml:"invitation_ttl" env:"USER_INVITATION_TTL" required:"true"`
+}
+
+func (r RegistrationConfig) Validate() error {
+	if r.InvitationTTL < time.Second {
+		return fmt.Errorf("USER_INVITATION_TTL must be at least a second")
+	}
+	return nil
+}
+
+// OrganizationsConfig configures organizations
+type OrganizationsConfig struct {
+	// InvitationTTL is how long an invitation can be accepted
+	InvitationTTL time.Duration `yaml:"invitation_ttl" env:"ORG_INVITATION_TTL" required:"true"`
+}
+
+func (o OrganizationsConfig) Validate() error {
+	if o.InvitationTTL < time.Second {
+		return fmt.Errorf("ORG_INVITATION_TTL must be at least a second")
+	}
+	return nil
+}
+
+// AccountsConfig configures account deletion and data exports
+type AccountsConfig struct {
+	// DeletionGracePeriod is how long users can cancel the deletion of their
+	// account before the sweeper deletes it
+	DeletionGracePeriod time.Duration `yaml:"deletion_grace_period" env:"ACCOUNT_DELETION_GRACE_PERIOD" required:"true"`
+	// ExportInterval is how often exports waiting to be run are looked for
+	ExportInterval time.Duration `yaml:"export_interval" env:"ACCOUNT_EXPORT_INTERVAL" required:"true"`
+	// ExportTTL is how long a finished export can be downloaded
+	ExportTTL time.Duration `yaml:"export_ttl" env:"ACCOUNT_EXPORT_TTL" required:"true"`
+}
+
+func (a AccountsConfig) Validate() error {
+	if a.DeletionGracePeriod <= 0 || a.ExportInterval <= 0 {
+		return fmt.Errorf("ACCOUNT_DELETION_GRACE_PERIOD and ACCOUNT_EXPORT_INTERVAL must be positive")
+	}
+	if a.ExportTTL < time.Second {
+		return fmt.Errorf("ACCOUNT_EXPORT_TTL must be at least a second")
+	}
+	return nil
+}
+
+// SweeperConfig configures the cleanup of stale verification data
+type SweeperConfig struct {
+	Interval         time.Duration `yaml:"interval" env:"SWEEP_INTERVAL" required:"true"`
+	UnverifiedMaxAge time.Duration `yaml:"unverified_max_age" env:"UNVERIFIED_ACCOUNT_MAX_AGE" required:"true"`
+}
+
+func (s SweeperConfig) Validate() error {
+	if s.Interval <= 0 || s.UnverifiedMaxAge <= 0 {
+		return fmt.Errorf("SWEEP_INTERVAL and UNVERIFIED_ACCOUNT_MAX_AGE must be positive")
+	}
+	return nil
+}
+
+var cfg = Config{
+	HTTP:      config.HTTP{Port: 3000, ShutdownTimeout: 15 * time.Second},
+	Log:       config.Log{Level: "info"},
+	Tracing:   config.Tracing{Exporter: "none"},
+	Cassandra: config.DefaultCassandra(),
+	SMTP:      config.DefaultSMTP(),
+	Sweeper: SweeperConfig{
+		Interval:         time.Hour,
+		UnverifiedMaxAge: 7 * 24 * time.Hour,
+	},
+	Webhooks:   config.DefaultWebhooks(),
+	EmailCodes: config.DefaultEmailCodes(),
+	Tenancy:    config.DefaultTenancy(),
+	Registration: RegistrationConfig{
+		Open:          true,
+		InvitationTTL: 7 * 24 * time.Hour,
+	},
+	Organizations: OrganizationsConfig{
+		InvitationTTL: 7 * 24 * time.Hour,
+	},
+	Accounts: AccountsConfig{
+		DeletionGracePeriod: 30 * 24 * time.Hour,
+		ExportInterval:      time.Minute,
+		ExportTTL:           7 * 24 * time.Hour,
+	},
+	PublicURL: "http://localhost:3000",
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/apikey"
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/caller"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tracing"
+	"github.com/bdobrica/LLMDesignedApp/go-common/userstatus"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Users ask for a copy of everything held about them with POST /me/exports.
+// Exports are queued in user_export_queue and run by runExporter; the
+// archive can be downloaded until cfg.Accounts.ExportTTL after the request.
+
+// Export statuses
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+)
+
+// exportRequests wakes runExporter up when an export is requested
+var exportRequests = make(chan struct{}, 1)
+
+// Export is a data export without its archive
+type Export struct {
+	ID          gocql.UUID `json:"id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// Archive is everything held about a user
+type Archive struct {
+	ExportedAt    time.Time          `json:"exported_at"`
+	User          ArchivedUser       `json:"user"`
+	Identities    []ArchivedIdentity `json:"identities"`
+	Organizations []Organization     `json:"organizations"`
+	APIKeys       []apikey.Key       `json:"api_keys"`
+	Sessions      []ArchivedSession  `json:"sessions"`
+	AuditEvents   []audit.Event      `json:"audit_events"`
+}
+
+// ArchivedUser is the users row of an archive
+type ArchivedUser struct {
+	ID                  gocql.UUID `json:"id"`
+	Tenant              string     `json:"tenant"`
+	Username            string     `json:"username"`
+	Email               string     `json:"email"`
+	EmailVerified       bool       `json:"email_verified"`
+	Roles               []string   `json:"roles"`
+	Locale              string     `json:"locale,omitempty"`
+	AuthSource          string     `json:"auth_source,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	// Status is the status in force, with the reason and end it was given
+	Status       userstatus.Status `json:"status"`
+	StatusReason string            `json:"status_reason,omitempty"`
+	StatusUntil  *time.Time        `json:"status_until,omitempty"`
+}
+
+// ArchivedIdentity is an external identity linked to the user
+type ArchivedIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ArchivedSession is a refresh token of the user, without the token
+type ArchivedSession struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// requestExport queues an export of the caller's data. While an export is
+// pending, asking again returns it instead of queueing another.
+func requestExport(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	userID := caller.From(c).UserID
+	exports, err := listUserExports(ctx, userID)
+	if err != nil {
+		return response.Internal(err, "Error requesting export")
+	}
+	for _, export := range exports {
+		if export.Status == exportPending {
+			return response.Success(c, fiber.StatusAccepted, "", export)
+		}
+	}
+
+	export := Export{ID: gocql.TimeUUID(), Status: exportPending}
+	export.CreatedAt = export.ID.Time()
+	ttl := int(cfg.Accounts.ExportTTL.Seconds())
+	err = session.Query(`INSERT INTO user_exports (user_id, id, status) VALUES (?, ?, ?) USING TTL ?`, userID, export.ID, export.Status, ttl).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error requesting export")
+	}
+	err = session.Query(`INSERT INTO user_export_queue (id, user_id) VALUES (?, ?) USING TTL ?`, export.ID, userID, ttl).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error requesting export")
+	}
+	select {
+	case exportRequests <- struct{}{}:
+	default:
+	}
+
+	event := audit.FromRequest(c, audit.ExportRequested, userID)
+	event.Details = map[string]string{"export_id": export.ID.String()}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusAccepted, "", export)
+}
+
+// listExports lists the caller's exports that can still be downloaded, newest first
+func listExports(c *fiber.Ctx) error {
+	exports, err := listUserExports(c.UserContext(), caller.From(c).UserID)
+	if err != nil {
+		return response.Internal(err, "Error listing exports")
+	}
+	if exports == nil {
+		exports = []Export{}
+	}
+
+	return response.Success(c, fiber.StatusOK, "", exports)
+}
+
+// getExport returns one of the caller's exports
+func getExport(c *fiber.Ctx) error {
+	export, _, err := findExport(c)
+	if err != nil {
+		return err
+	}
+
+	return response.Success(c, fiber.StatusOK, "", export)
+}
+
+// downloadExport answers with the archive of one of the caller's exports
+func downloadExport(c *fiber.Ctx) error {
+	export, archive, err := findExport(c)
+	if err != nil {
+		return err
+	}
+	if export.Status != exportReady {
+		return response.New(response.CodeExportNotReady, "Export is not ready yet")
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	c.Attachment("export-" + export.ID.String() + ".json")
+	return c.SendString(archive)
+}
+
+// findExport returns the export named by the id parameter, with its archive,
+// or an error ready to be returned by a handler
+func findExport(c *fiber.Ctx) (Export, string, error) {
+	ctx := c.UserContext()
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return Export{}, "", response.New(response.CodeBadRequest, "Invalid export ID")
+	}
+
+	export := Export{ID: id, CreatedAt: id.Time()}
+	var archive string
+	var completedAt time.Time
+	err = session.Query(`SELECT status, archive, completed_at FROM user_exports WHERE user_id = ? AND id = ?`, caller.From(c).UserID, id).WithContext(ctx).
+		Scan(&export.Status, &archive, &completedAt)
+	if err == gocql.ErrNotFound {
+		return Export{}, "", response.New(response.CodeNotFound, "Export not found")
+	}
+	if err != nil {
+		return Export{}, "", response.Internal(err, "Error retrieving export")
+	}
+	if !completedAt.IsZero() {
+		export.CompletedAt = &completedAt
+	}
+	return export, archive, nil
+}
+
+// listUserExports returns the exports of userID, newest first
+func listUserExports(ctx context.Context, userID gocql.UUID) ([]Export, error) {
+	var exports []Export
+	var export Export
+	var completedAt time.Time
+	iter := session.Query(`SELECT id, status, completed_at FROM user_exports WHERE user_id = ?`, userID).WithContext(ctx).Iter()
+	for iter.Scan(&export.ID, &export.Status, &completedAt) {
+		export.CreatedAt = export.ID.Time()
+		if !completedAt.IsZero() {
+			done := completedAt
+			export.CompletedAt = &done
+		}
+		exports = append(exports, export)
+		export, completedAt = Export{}, time.Time{}
+	}
+	return exports, iter.Close()
+}
+
+// runExporter runs the queued exports right away, then on every interval
+// and whenever one is requested, until ctx is done
+func runExporter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := runExports(ctx); err != nil {
+			slog.Error("Exporter failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-exportRequests:
+		}
+	}
+}
+
+// runExports runs every queued export. An export leaves the queue once its
+// archive is stored, so exports interrupted by a restart run again, and
+// replicas running the same export store the same archive.
+func runExports(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "exporter.run")
+	defer func() { tracing.End(span, err) }()
+
+	type job struct{ id, userID gocql.UUID }
+	var jobs []job
+	var j job
+	iter := session.Query(`SELECT id, user_id FROM user_export_queue`).WithContext(ctx).Iter()
+	for iter.Scan(&j.id, &j.userID) {
+		jobs = append(jobs, j)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for _, j := range jobs {
+		if err := runExport(ctx, j.id, j.userID); err != nil {
+			slog.Error("Error running export", "export_id", j.id, "user_id", j.userID, "error", err)
+			continue
+		}
+		if err := session.Query(`DELETE FROM user_export_queue WHERE id = ?`, j.id).WithContext(ctx).Exec(); err != nil {
+			slog.Error("Error dequeueing export", "export_id", j.id, "error", err)
+		}
+	}
+	return nil
+}
+
+// runExport builds the archive of userID and stores it in the export id.
+// Exports of users deleted meanwhile are dropped.
+func runExport(ctx context.Context, id, userID gocql.UUID) error {
+	account, err := loadAccount(ctx, userID)
+	if err == gocql.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Identities and organizations are looked up in the user's tenant, which
+	// may no longer be configured
+	t, ok := tenants.Get(account.Tenant)
+	if !ok {
+		t = &tenant.Tenant{ID: account.Tenant}
+	}
+	archive, err := buildArchive(tenant.NewContext(ctx, t), account)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(archive)
+	if err != nil {
+		return err
+	}
+
+	// The archive expires along with the rest of the export
+	ttl := max(int(time.Until(id.Time().Add(cfg.Accounts.ExportTTL)).Seconds()), 1)
+	return session.Query(`UPDATE user_exports USING TTL ? SET status = ?, archive = ?, completed_at = ? WHERE user_id = ? AND id = ?`,
+		ttl, exportReady, string(raw), archive.ExportedAt, userID, id).WithContext(ctx).Exec()
+}
+
+// buildArchive collects everything held about the user of account in the
+// tenant in ctx
+func buildArchive(ctx context.Context, account Account) (Archive, error) {
+	archive := Archive{
+		ExportedAt:    time.Now(),
+		Identities:    []ArchivedIdentity{},
+		Organizations: []Organization{},
+		Sessions:      []ArchivedSession{},
+	}
+	user := &archive.User
+	var (
+		deletionScheduledAt time.Time
+		status              string
+		statusUntil         time.Time
+	)
+	err := session.Query(`SELECT username, email, email_verified, roles, locale, auth_source, created_at, deletion_scheduled_at, status, status_reason, status_until FROM users WHERE id = ?`, account.ID).WithContext(ctx).
+		Scan(&user.Username, &user.Email, &user.EmailVerified, &user.Roles, &user.Locale, &user.AuthSource, &user.CreatedAt, &deletionScheduledAt, &status, &user.StatusReason, &statusUntil)
+	if err != nil {
+		return Archive{}, err
+	}
+	user.Status = userstatus.Effective(status, statusUntil, archive.ExportedAt)
+	if !statusUntil.IsZero() {
+		user.StatusUntil = &statusUntil
+	}
+	user.ID, user.Tenant = account.ID, account.Tenant
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+	if !deletionScheduledAt.IsZero() {
+		user.DeletionScheduledAt = &deletionScheduledAt
+	}
+
+	var identity ArchivedIdentity
+	iter := session.Query(`SELECT provider, subject, created_at FROM user_identities_by_user WHERE user_id = ?`, account.ID).WithContext(ctx).Iter()
+	for iter.Scan(&identity.Provider, &identity.Subject, &identity.CreatedAt) {
+		archive.Identities = append(archive.Identities, identity)
+	}
+	if err := iter.Close(); err != nil {
+		return Archive{}, err
+	}
+	for i := range archive.Identities {
+		identity := &archive.Identities[i]
+		err := session.Query(`SELECT email FROM tenant_user_identities WHERE tenant = ? AND provider = ? AND subject = ?`,
+			account.Tenant, identity.Provider, identity.Subject).WithContext(ctx).Scan(&identity.Email)
+		if err != nil && err != gocql.ErrNotFound {
+			return Archive{}, err
+		}
+	}
+
+	memberships, err := listMemberships(ctx, account.ID)
+	if err != nil {
+		return Archive{}, err
+	}
+	for _, membership := range memberships {
+		org, err := loadOrganization(ctx, membership.ID)
+		if err == gocql.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return Archive{}, err
+		}
+		org.Role = membership.Role
+		archive.Organizations = append(archive.Organizations, org)
+	}
+
+	if archive.APIKeys, err = apiKeys.List(ctx, account.ID); err != nil {
+		return Archive{}, err
+	}
+	if archive.APIKeys == nil {
+		archive.APIKeys = []apikey.Key{}
+	}
+
+	var refresh ArchivedSession
+	iter = session.Query(`SELECT expires_at FROM refresh_tokens_by_user WHERE user_id = ?`, account.ID).WithContext(ctx).Iter()
+	for iter.Scan(&refresh.ExpiresAt) {
+		archive.Sessions = append(archive.Sessions, refresh)
+	}
+	if err := iter.Close(); err != nil {
+		return Archive{}, err
+	}
+
+	if archive.AuditEvents, err = auditLog.History(ctx, account.ID, account.since()); err != nil {
+		return Archive{}, err
+	}
+	if archive.AuditEvents == nil {
+		archive.AuditEvents = []audit.Event{}
+	}
+	return archive, nil
+}
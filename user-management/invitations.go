@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/auth"
+	"github.com/bdobrica/LLMDesignedApp/go-common/caller"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
+)
+
+// Invitations are sent by email and can be accepted by the user with the
+// invited address, or declined by anyone holding the link, until they expire
+// after cfg.Organizations.InvitationTTL. Only the hash of a token is stored.
+
+// Invitation is a pending invitation to an organization, without its token
+type Invitation struct {
+	ID        gocql.UUID `json:"id"`
+	Email     string     `json:"email"`
+	Role      string     `json:"role"`
+	InvitedBy gocql.UUID `json:"invited_by"`
+	ExpiresAt time.Time  `json:"expires_at"`
+
+	tokenHash string
+}
+
+// InvitationRequest is the body accepted when inviting someone
+type InvitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// createInvitation invites an email address to the organization. Owners and
+// admins may invite, with roles up to their own.
+func createInvitation(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	request := new(InvitationRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	var fields []response.FieldError
+	email, err := identity.NormalizeEmail(request.Email)
+	if err != nil {
+		fields = append(fields, response.Field("email", err))
+	}
+	if _, ok := roleRank[request.Role]; !ok {
+		fields = append(fields, response.FieldError{Field: "role", Code: response.CodeFieldNotAllowed, Message: "role must be owner, admin or member"})
+	}
+	if len(fields) > 0 {
+		return response.Invalid(fields...)
+	}
+	org, err := callerOrganization(c)
+	if err != nil {
+		return err
+	}
+	if roleRank[org.Role] < roleRank[roleAdmin] || !mayManage(org.Role, request.Role) {
+		return response.New(response.CodeForbidden, "You cannot invite members with this role")
+	}
+
+	token, err := auth.GenerateBase64RandomToken(43)
+	if err != nil {
+		return response.Internal(err, "Error creating invitation")
+	}
+	userID := caller.From(c).UserID
+	invitation := Invitation{
+		ID:        gocql.TimeUUID(),
+		Email:     email,
+		Role:      request.Role,
+		InvitedBy: userID,
+		ExpiresAt: time.Now().Add(cfg.Organizations.InvitationTTL),
+		tokenHash: hashToken(token),
+	}
+	ttl := int(cfg.Organizations.InvitationTTL.Seconds())
+	err = session.Query(`INSERT INTO organization_invitations_by_org (org_id, id, token_hash, email, role, invited_by, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+		org.ID, invitation.ID, invitation.tokenHash, invitation.Email, invitation.Role, invitation.InvitedBy, invitation.ExpiresAt, ttl).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error creating invitation")
+	}
+	err = session.Query(`INSERT INTO organization_invitations (token_hash, id, org_id, email, role, invited_by, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+		invitation.tokenHash, invitation.ID, org.ID, invitation.Email, invitation.Role, invitation.InvitedBy, invitation.ExpiresAt, ttl).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error creating invitation")
+	}
+
+	// An invitation that never arrived is withdrawn, so that it can be sent again
+	if err := sendInvitationEmail(ctx, email, org.Name, token, i18n.Locale(c)); err != nil {
+		if err := deleteInvitation(ctx, org.ID, invitation.ID, invitation.tokenHash); err != nil {
+			return response.Internal(err, "Error withdrawing invitation")
+		}
+		return response.Wrap(response.CodeEmailDeliveryFailed, err, "Error sending email")
+	}
+
+	event := audit.FromRequest(c, audit.OrgInviteSent, userID)
+	event.Details = map[string]string{"org_id": org.ID.String(), "invitation_id": invitation.ID.String(), "role": invitation.Role}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusCreated, "", invitation)
+}
+
+// listInvitations lists the pending invitations of the organization, newest
+// first. Owners and admins may list them.
+func listInvitations(c *fiber.Ctx) error {
+	org, err := callerOrganization(c)
+	if err != nil {
+		return err
+	}
+	if roleRank[org.Role] < roleRank[roleAdmin] {
+		return response.New(response.CodeForbidden, "Only owners and admins can manage invitations")
+	}
+
+	invitations, err := listPendingInvitations(c.UserContext(), org.ID)
+	if err != nil {
+		return response.Internal(err, "Error listing invitations")
+	}
+	if invitations == nil {
+		invitations = []Invitation{}
+	}
+
+	return response.Success(c, fiber.StatusOK, "", invitations)
+}
+
+// revokeInvitation withdraws a pending invitation. Owners and admins may
+// revoke it.
+func revokeInvitation(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	org, err := callerOrganization(c)
+	if err != nil {
+		return err
+	}
+	if roleRank[org.Role] < roleRank[roleAdmin] {
+		return response.New(response.CodeForbidden, "Only owners and admins can manage invitations")
+	}
+	id, err := gocql.ParseUUID(c.Params("invitation_id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid invitation ID")
+	}
+
+	var tokenHash string
+	err = session.Query(`SELECT token_hash FROM organization_invitations_by_org WHERE org_id = ? AND id = ?`, org.ID, id).WithContext(ctx).Scan(&tokenHash)
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeNotFound, "Invitation not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error revoking invitation")
+	}
+	if err := deleteInvitation(ctx, org.ID, id, tokenHash); err != nil {
+		return response.Internal(err, "Error revoking invitation")
+	}
+
+	return response.Success(c, fiber.StatusOK, "Invitation revoked", nil)
+}
+
+// acceptInvitation makes the caller a member of the organization they were
+// invited to. The caller's verified email address must be the invited one.
+// Members keep their role.
+func acceptInvitation(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	userID := caller.From(c).UserID
+	invitation, orgID, err := findInvitation(ctx, c.Params("token"))
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeTokenInvalid, "Invalid or expired invitation")
+	}
+	if err != nil {
+		return response.Internal(err, "Error accepting invitation")
+	}
+
+	var email string
+	var emailVerified bool
+	if err := session.Query(`SELECT email, email_verified FROM users WHERE id = ?`, userID).WithContext(ctx).Scan(&email, &emailVerified); err != nil {
+		return response.Internal(err, "Error accepting invitation")
+	}
+	if !emailVerified || identity.EmailKey(email) != identity.EmailKey(invitation.Email) {
+		return response.New(response.CodeInvitationMismatch, "This invitation was sent to another email address")
+	}
+
+	if err := consumeInvitation(ctx, orgID, invitation); err == gocql.ErrNotFound {
+		return response.New(response.CodeTokenInvalid, "Invalid or expired invitation")
+	} else if err != nil {
+		return response.Internal(err, "Error accepting invitation")
+	}
+	_, err = memberRole(ctx, orgID, userID)
+	if err == gocql.ErrNotFound {
+		err = addMember(ctx, orgID, userID, invitation.Role)
+	}
+	if err != nil {
+		return response.Internal(err, "Error accepting invitation")
+	}
+
+	event := audit.FromRequest(c, audit.OrgJoined, userID)
+	event.Details = map[string]string{"org_id": orgID.String(), "invitation_id": invitation.ID.String(), "role": invitation.Role}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusOK, "Invitation accepted", fiber.Map{"org_id": orgID})
+}
+
+// declineInvitation withdraws an invitation on behalf of its recipient, who
+// need not have an account
+func declineInvitation(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	invitation, orgID, err := findInvitation(ctx, c.Params("token"))
+	if err == nil {
+		err = consumeInvitation(ctx, orgID, invitation)
+	}
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeTokenInvalid, "Invalid or expired invitation")
+	}
+	if err != nil {
+		return response.Internal(err, "Error declining invitation")
+	}
+
+	return response.Success(c, fiber.StatusOK, "Invitation declined", nil)
+}
+
+// findInvitation returns the invitation with token and its organization.
+// Unknown and expired invitations, and invitations to organizations of other
+// tenants, yield gocql.ErrNotFound.
+func findInvitation(ctx context.Context, token string) (Invitation, gocql.UUID, error) {
+	invitation := Invitation{tokenHash: hashToken(token)}
+	var orgID gocql.UUID
+	err := session.Query(`SELECT id, org_id, email, role, invited_by, expires_at FROM organization_invitations WHERE token_hash = ?`, invitation.tokenHash).WithContext(ctx).
+		Scan(&invitation.ID, &orgID, &invitation.Email, &invitation.Role, &invitation.InvitedBy, &invitation.ExpiresAt)
+	if err != nil {
+		return Invitation{}, gocql.UUID{}, err
+	}
+	// The TTL may not have removed the row yet
+	if time.Now().After(invitation.ExpiresAt) {
+		return Invitation{}, gocql.UUID{}, gocql.ErrNotFound
+	}
+	if _, err := loadOrganization(ctx, orgID); err != nil {
+		return Invitation{}, gocql.UUID{}, err
+	}
+	return invitation, orgID, nil
+}
+
+// consumeInvitation deletes an invitation with a lightweight transaction, so
+// that it is only ever used once; gocql.ErrNotFound if it already was
+func consumeInvitation(ctx context.Context, orgID gocql.UUID, invitation Invitation) error {
+	applied, err := session.Query(`DELETE FROM organization_invitations WHERE token_hash = ? IF EXISTS`, invitation.tokenHash).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{}))
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return gocql.ErrNotFound
+	}
+	return session.Query(`DELETE FROM organization_invitations_by_org WHERE org_id = ? AND id = ?`, orgID, invitation.ID).WithContext(ctx).Exec()
+}
+
+// deleteInvitation removes both rows of an invitation
+func deleteInvitation(ctx context.Context, orgID, id gocql.UUID, tokenHash string) error {
+	if err := session.Query(`DELETE FROM organization_invitations WHERE token_hash = ?`, tokenHash).WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	return session.Query(`DELETE FROM organization_invitations_by_org WHERE org_id = ? AND id = ?`, orgID, id).WithContext(ctx).Exec()
+}
+
+// listPendingInvitations returns the invitations of orgID, newest first
+func listPendingInvitations(ctx context.Context, orgID gocql.UUID) ([]Invitation, error) {
+	var invitations []Invitation
+	var invitation Invitation
+	iter := session.Query(`SELECT id, token_hash, email, role, invited_by, expires_at FROM organization_invitations_by_org WHERE org_id = ?`, orgID).WithContext(ctx).Iter()
+	for iter.Scan(&invitation.ID, &invitation.tokenHash, &invitation.Email, &invitation.Role, &invitation.InvitedBy, &invitation.ExpiresAt) {
+		invitations = append(invitations, invitation)
+	}
+	return invitations, iter.Close()
+}
+
+// sendInvitationEmail sends an invitation to orgName in the language tag
+func sendInvitationEmail(ctx context.Context, to, orgName, token string, tag language.Tag) error {
+	link := fmt.Sprintf("%s/invitations/%s", tenant.FromContext(ctx).PublicURL, token)
+
+	subject := fmt.Sprintf(i18n.Translate(tag, "You have been invited to join %s"), orgName)
+	body := fmt.Sprintf(`
+        <h1>%s</h1>
+        <p>%s</p>
+        <a href="%s">%s</a>
+    `, html.EscapeString(subject),
+		html.EscapeString(fmt.Sprintf(i18n.Translate(tag, "Click the following link to accept or decline the invitation. It expires in %d days."), int(cfg.Organizations.InvitationTTL.Hours()/24))),
+		link,
+		html.EscapeString(i18n.Translate(tag, "View invitation")))
+
+	return mailer.Send(ctx, to, subject, body)
+}
+
+// hashToken returns the form in which an invitation token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+
+	"github.com/gocql/gocql"
+)
+
+// Usernames and emails are claimed under their case-insensitive keys, see
+// identity.UsernameKey and identity.EmailKey, within the tenant in ctx
+
+// claimUsername reserves username for userID. It reports false if another
+// user already holds it.
+func claimUsername(ctx context.Context, username string, userID gocql.UUID) (bool, error) {
+	return session.Query(`INSERT INTO tenant_users_by_username (tenant, username, user_id) VALUES (?, ?, ?) IF NOT EXISTS`,
+		tenant.FromContext(ctx).ID, identity.UsernameKey(username), userID).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{}))
+}
+
+// claimEmail reserves email for userID. It reports false if another user
+// already holds it.
+func claimEmail(ctx context.Context, email string, userID gocql.UUID) (bool, error) {
+	return session.Query(`INSERT INTO tenant_users_by_email (tenant, email, user_id) VALUES (?, ?, ?) IF NOT EXISTS`,
+		tenant.FromContext(ctx).ID, identity.EmailKey(email), userID).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{}))
+}
+
+// releaseUsername frees a username claim, but only if userID still holds it
+func releaseUsername(ctx context.Context, username string, userID gocql.UUID) {
+	if _, err := session.Query(`DELETE FROM tenant_users_by_username WHERE tenant = ? AND username = ? IF user_id = ?`,
+		tenant.FromContext(ctx).ID, identity.UsernameKey(username), userID).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{})); err != nil {
+		slog.Error("Error releasing username claim", "user_id", userID, "error", err)
+	}
+}
+
+// releaseEmail frees an email claim, but only if userID still holds it
+func releaseEmail(ctx context.Context, email string, userID gocql.UUID) {
+	if _, err := session.Query(`DELETE FROM tenant_users_by_email WHERE tenant = ? AND email = ? IF user_id = ?`,
+		tenant.FromContext(ctx).ID, identity.EmailKey(email), userID).WithContext(ctx).
+		MapScanCAS(make(map[string]interface{})); err != nil {
+		slog.Error("Error releasing email claim", "user_id", userID, "error", err)
+	}
+}
+
+// lookupUserIDByEmail resolves an email to the ID of the user that claimed it
+func lookupUserIDByEmail(ctx context.Context, email string) (gocql.UUID, error) {
+	var userID gocql.UUID
+	err := session.Query(`SELECT user_id FROM tenant_users_by_email WHERE tenant = ? AND email = ?`,
+		tenant.FromContext(ctx).ID, identity.EmailKey(email)).WithContext(ctx).Scan(&userID)
+	return userID, err
+}
@@ -1,31 +1,86 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/tls"
+	_ "embed"
 	"encoding/hex"
 	"fmt"
+	"html"
 	"log"
+	"log/slog"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/bdobrica/LLMDesignedApp/go-common/apikey"
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/caller"
+	"github.com/bdobrica/LLMDesignedApp/go-common/cassandra"
+	"github.com/bdobrica/LLMDesignedApp/go-common/config"
+	"github.com/bdobrica/LLMDesignedApp/go-common/emailcode"
+	"github.com/bdobrica/LLMDesignedApp/go-common/health"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/mail"
+	"github.com/bdobrica/LLMDesignedApp/go-common/metrics"
+	"github.com/bdobrica/LLMDesignedApp/go-common/openapi"
+	"github.com/bdobrica/LLMDesignedApp/go-common/ratelimit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/schema"
+	"github.com/bdobrica/LLMDesignedApp/go-common/server"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tracing"
+	"github.com/bdobrica/LLMDesignedApp/go-common/webhook"
 	"github.com/gocql/gocql"
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/gomail.v2"
+	"golang.org/x/text/language"
 )
 
-var session *gocql.Session
+// openapiDocument describes every route of the service
+//
+//go:embed openapi.yaml
+var openapiDocument []byte
+
+var (
+	session  *gocql.Session
+	auditLog *audit.Recorder
+	webhooks *webhook.Dispatcher
+	mailer   mail.Sender
+	tenants  *tenant.Registry
+	apiKeys  *apikey.Store
+
+	emailCodes       *emailcode.Store
+	emailCodeLimiter *ratelimit.Limiter
+)
+
+// Lifetimes of the tokens stored in users.verification_token. Tokens past
+// their expiry are rejected and later cleared by the sweeper.
+const (
+	verificationTokenLifetime = 24 * time.Hour
+	recoveryTokenLifetime     = time.Hour
+)
 
 type User struct {
 	ID                gocql.UUID `json:"id"`
 	Username          string     `json:"username"`
 	Email             string     `json:"email"`
-	Password          string     `json:"password"`
+	Password          string     `json:"-"`
 	EmailVerified     bool       `json:"email_verified"`
-	VerificationToken string     `json:"verification_token"`
+	VerificationToken string     `json:"-"`
+}
+
+// RegisterRequest is the body accepted by /register; see Validate for the rules
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Locale is the preferred language, e.g. "de"; optional
+	Locale string `json:"locale"`
 }
 
 type RecoverRequest struct {
@@ -36,304 +91,449 @@ type ResetRequest struct {
 	Password string `json:"password"`
 }
 
-type Response struct {
-	Status  bool   `json:"status"`
-	Message string `json:"message,omitempty"` // Use omitempty to skip empty messages
-	Data    *User  `json:"data,omitempty"`    // Use pointer to User to allow for nil when there's no user data
-	Error   *Error `json:"error,omitempty"`   // Optional error field for detailed errors
-}
+func main() {
+	// Load and validate configuration before touching any dependency
+	if err := config.Load(&cfg); err != nil {
+		log.Fatal("Invalid configuration:\n", err)
+	}
 
-type Error struct {
-	Message string `json:"message"`
-	Detail  string `json:"detail,omitempty"`
-}
+	// Log JSON with secrets and emails redacted
+	logger, err := logging.Setup("user-management", cfg.Log.Level)
+	if err != nil {
+		log.Fatal("Unable to set up logging:", err)
+	}
 
-func main() {
-	// Connect to Cassandra
-	cassandraHosts := strings.Split(os.Getenv("CASSANDRA_HOSTS"), ",")
-	cluster := gocql.NewCluster(cassandraHosts...)
-	cluster.Keyspace = os.Getenv("CASSANDRA_KEYSPACE")
-	cluster.Consistency = gocql.Quorum
-	var err error
-	session, err = cluster.CreateSession()
+	// Export traces when configured; W3C trace context is propagated either way
+	shutdownTracing, err := tracing.Setup(context.Background(), "user-management", cfg.Tracing)
 	if err != nil {
-		log.Fatal("Unable to connect to Cassandra:", err)
+		slog.Error("Unable to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	// SIGINT and SIGTERM cancel ctx, which starts the graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Connect to Cassandra, waiting for it to come up if needed
+	cluster := cfg.Cassandra.NewCluster()
+	cluster.QueryObserver = cassandra.QueryObservers{metrics.CassandraObserver{}, tracing.CassandraObserver{}}
+	cluster.BatchObserver = cassandra.BatchObservers{metrics.CassandraObserver{}, tracing.CassandraObserver{}}
+	session, err = cassandra.Connect(ctx, cluster, cassandra.Backoff{Total: cfg.Cassandra.ConnectTimeout})
+	if err != nil {
+		slog.Error("Unable to connect to Cassandra", "error", err)
+		os.Exit(1)
 	}
 	defer session.Close()
+	auditLog = &audit.Recorder{Session: session}
+	apiKeys = &apikey.Store{Session: session}
+	mailer = mail.Sender{Config: cfg.SMTP}
+	webhooks = webhook.NewDispatcher(session, cfg.Webhooks)
+	emailCodes = &emailcode.Store{Session: session, Config: cfg.EmailCodes}
+	emailCodeLimiter = &ratelimit.Limiter{
+		Session: session,
+		Name:    "email_code",
+		Limit:   cfg.EmailCodes.RequestLimit,
+		Window:  cfg.EmailCodes.RequestWindow,
+	}
+	tenants = tenant.NewRegistry(cfg.Tenancy, config.Tenant{
+		JWTSecret:         cfg.JWTSecret,
+		PublicURL:         cfg.PublicURL,
+		SenderEmail:       cfg.SMTP.SenderEmail,
+		PasswordMinLength: passwordMinLength,
+	})
+
+	// Apply pending schema migrations when asked to
+	if cfg.Cassandra.MigrateOnStartup {
+		if err := schema.Migrate(ctx, session); err != nil {
+			slog.Error("Unable to migrate schema", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Periodically remove stale verification tokens, unverified accounts and
+	// accounts due for deletion
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		runSweeper(ctx, cfg.Sweeper.Interval, cfg.Sweeper.UnverifiedMaxAge)
+	}()
+
+	// Run data exports in the background
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		runExporter(ctx, cfg.Accounts.ExportInterval)
+	}()
+
+	// Deliver webhooks in the background
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		webhooks.Run(ctx)
+	}()
+
+	// Readiness depends on Cassandra, the schema version and, when mail is enabled, SMTP
+	expectedSchema, err := schema.Latest()
+	if err != nil {
+		slog.Error("Unable to load schema migrations", "error", err)
+		os.Exit(1)
+	}
+	var readiness health.Checker
+	readiness.Add("cassandra", health.CassandraCheck(session))
+	readiness.Add("schema", health.SchemaCheck(session, expectedSchema))
+	if cfg.SMTP.Host != "" {
+		readiness.Add("smtp", health.TCPCheck(cfg.SMTP.Addr()))
+	}
+
+	spec, err := openapi.Load(openapiDocument)
+	if err != nil {
+		slog.Error("Unable to load the OpenAPI document", "error", err)
+		os.Exit(1)
+	}
 
 	// Initialize Fiber
-	app := fiber.New()
+	app := fiber.New(fiber.Config{ErrorHandler: response.ErrorHandler})
+
+	// Probes are registered ahead of the middleware so they are neither logged nor traced
+	app.Get("/healthz", health.Liveness)
+	app.Get("/readyz", readiness.Readiness)
+
+	app.Use(tracing.Middleware())
+	app.Use(logging.Middleware(logger))
+	app.Use(metrics.Middleware())
+	// Every request belongs to a tenant, resolved by host or header
+	app.Use(tenants.Middleware())
+
+	// Admin requests and those of signed-in users are authenticated before
+	// their shape is validated
+	if cfg.AdminAPIToken != "" {
+		app.Use("/admin", requireAdmin)
+	}
+	signedIn := caller.Middleware(apiKeys)
+	app.Use("/me", signedIn)
+	app.Use("/orgs", signedIn)
+	app.Use("/invitations/:token/accept", signedIn)
+	app.Use(spec.Middleware())
 
 	// Routes
 	app.Post("/register", registerUser)
+	app.Get("/register/invitation/:token", getUserInvitation)
+	app.Post("/register/invitation/:token", registerInvitedUser)
 	app.Get("/verify/:token", verifyEmail)
 	app.Post("/recover", recoverPassword)
 	app.Post("/reset/:token", resetPassword)
+	// Code based alternatives to the links above, for native apps
+	app.Post("/verify/code/request", requestVerificationCode)
+	app.Post("/verify/code", verifyEmailCode)
+	app.Post("/recover/code/request", requestResetCode)
+	app.Post("/recover/code", resetPasswordCode)
+	app.Delete("/me", requestDeletion)
+	app.Delete("/me/deletion", cancelDeletion)
+	app.Post("/me/exports", requestExport)
+	app.Get("/me/exports", listExports)
+	app.Get("/me/exports/:id", getExport)
+	app.Get("/me/exports/:id/archive", downloadExport)
+	app.Post("/orgs", createOrganization)
+	app.Get("/orgs", listOrganizations)
+	app.Get("/orgs/:id", getOrganization)
+	app.Delete("/orgs/:id", deleteOrganization)
+	app.Patch("/orgs/:id/members/:user_id", updateMember)
+	app.Delete("/orgs/:id/members/:user_id", deleteMember)
+	app.Post("/orgs/:id/invitations", createInvitation)
+	app.Get("/orgs/:id/invitations", listInvitations)
+	app.Delete("/orgs/:id/invitations/:invitation_id", revokeInvitation)
+	app.Post("/invitations/:token/accept", acceptInvitation)
+	app.Post("/invitations/:token/decline", declineInvitation)
+	app.Get("/metrics", metrics.Handler())
+	app.Get("/openapi.json", spec.Handler)
+
+	// Admin routes are only served when an admin token is configured
+	if cfg.AdminAPIToken != "" {
+		admin := app.Group("/admin")
+		admin.Get("/audit/:user_id", queryAuditEvents)
+		admin.Delete("/users/:user_id", deleteUserAccount)
+		admin.Get("/users/:user_id/status", getUserStatus)
+		admin.Put("/users/:user_id/status", setUserStatus)
+		admin.Post("/invitations", createUserInvitation)
+		admin.Get("/invitations", listUserInvitations)
+		admin.Delete("/invitations/:id", revokeUserInvitation)
+		admin.Post("/webhooks", createWebhook)
+		admin.Get("/webhooks", listWebhooks)
+		admin.Delete("/webhooks/:id", deleteWebhook)
+		admin.Get("/webhooks/:id/deliveries", listWebhookDeliveries)
+	}
 
-	log.Fatal(app.Listen(":3000"))
+	// Serve until signalled, then drain requests and the workers before the
+	// deferred calls close the Cassandra session and flush traces
+	if err := server.Serve(ctx, app, cfg.HTTP.Addr(), cfg.HTTP.ShutdownTimeout, &workers); err != nil {
+		slog.Error("Server stopped", "error", err)
+	}
+	stop()
 }
 
-// Register a new user
+// Register a new user. While registration is closed, accounts are only
+// created from invitations, see registerInvitedUser.
 func registerUser(c *fiber.Ctx) error {
-	user := new(User)
-	if err := c.BodyParser(user); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(Response{
-			Status:  false,
-			Message: "Invalid request",
-		})
-	}
-
-	// Check if the username already exists
-	var existingUsername string
-	err := session.Query(`SELECT username FROM users WHERE username = ? LIMIT 1`, user.Username).Scan(&existingUsername)
-	if err != nil && err != gocql.ErrNotFound {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error checking username",
-		})
-	}
-	if existingUsername != "" {
-		return c.Status(fiber.StatusConflict).JSON(Response{
-			Status:  false,
-			Message: "Username already exists",
-		})
-	}
-
-	// Check if the email already exists
-	var existingEmail string
-	err = session.Query(`SELECT email FROM users WHERE email = ? LIMIT 1`, user.Email).Scan(&existingEmail)
-	if err != nil && err != gocql.ErrNotFound {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error checking email",
-		})
-	}
-	if existingEmail != "" {
-		return c.Status(fiber.StatusConflict).JSON(Response{
-			Status:  false,
-			Message: "Email already exists",
-		})
-	}
-
-	user.ID = gocql.TimeUUID()
-	user.EmailVerified = false
-	user.VerificationToken = generateToken()
-	hashedPassword, err := hashPassword(user.Password)
+	if !cfg.Registration.Open {
+		return response.New(response.CodeRegistrationClosed, "Registration is by invitation only")
+	}
+	request := new(RegisterRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+
+	user, err := createUser(c, request, nil)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error hashing password",
-			Data:    nil,
-			Error: &Error{
-				Message: "Internal server error",
-				Detail:  err.Error(),
-			},
-		})
+		return err
+	}
+
+	// The account stands even if the link cannot be sent; a verification
+	// code can be asked for instead
+	tag, ok := i18n.Parse(request.Locale)
+	if !ok {
+		tag = i18n.Locale(c)
+	}
+	if err := sendVerificationEmail(c.UserContext(), user.Email, user.VerificationToken, tag); err != nil {
+		logging.FromCtx(c).Error("Error sending verification email", "user_id", user.ID, "error", err)
+	}
+
+	// Include user data in the response
+	return response.Success(c, fiber.StatusCreated, "", user)
+}
+
+// createUser validates request and creates the account it describes. An
+// account created from an invitation gets the invitation's roles and counts
+// as verified; any other gets a verification token. The returned error is
+// ready to be returned by a handler.
+func createUser(c *fiber.Ctx, request *RegisterRequest, invitation *UserInvitation) (*User, error) {
+	ctx := c.UserContext()
+	t := tenant.FromContext(ctx)
+	if fields := request.Validate(i18n.Locale(c), t.PasswordMinLength); len(fields) > 0 {
+		return nil, response.Invalid(fields...)
+	}
+
+	user := &User{
+		ID:       gocql.TimeUUID(),
+		Username: request.Username,
+		Email:    request.Email,
+		Password: request.Password,
+	}
+
+	// Claim the username; the lightweight transaction makes concurrent claims safe
+	claimed, err := claimUsername(ctx, user.Username, user.ID)
+	if err != nil {
+		return nil, response.Internal(err, "Error checking username")
+	}
+	if !claimed {
+		return nil, response.New(response.CodeUsernameTaken, "Username already exists")
+	}
+
+	// Claim the email, giving the username back if that fails
+	claimed, err = claimEmail(ctx, user.Email, user.ID)
+	if err != nil || !claimed {
+		releaseUsername(ctx, user.Username, user.ID)
+	}
+	if err != nil {
+		return nil, response.Internal(err, "Error checking email")
+	}
+	if !claimed {
+		return nil, response.New(response.CodeEmailTaken, "Email already exists")
+	}
+
+	// Any failure from here on must release both claims
+	registered := false
+	defer func() {
+		if !registered {
+			releaseUsername(ctx, user.Username, user.ID)
+			releaseEmail(ctx, user.Email, user.ID)
+		}
+	}()
+
+	// Invitations were sent to the address, so it needs no verification
+	now := time.Now()
+	var (
+		roles                 []string
+		verificationToken     *string
+		verificationExpiresAt *time.Time
+	)
+	if invitation != nil {
+		user.EmailVerified = true
+		roles = invitation.Roles
+	} else {
+		user.VerificationToken = generateToken()
+		expiresAt := now.Add(verificationTokenLifetime)
+		verificationToken, verificationExpiresAt = &user.VerificationToken, &expiresAt
+	}
+	hashedPassword, err := hashPassword(ctx, user.Password)
+	if err != nil {
+		return nil, response.Internal(err, "Error hashing password")
 	}
 
 	// Insert user into Cassandra
 	if err := session.Query(`
-        INSERT INTO users (id, username, email, password, email_verified, verification_token, created_at)
-        VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		user.ID, user.Username, user.Email, hashedPassword, user.EmailVerified, user.VerificationToken, time.Now()).Exec(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error registering user",
-		})
+        INSERT INTO users (id, tenant, username, email, password, email_verified, verification_token, verification_token_expires_at, roles, created_at, locale)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, t.ID, user.Username, user.Email, hashedPassword, user.EmailVerified, verificationToken, verificationExpiresAt, roles, now, request.Locale).WithContext(ctx).Exec(); err != nil {
+		return nil, response.Internal(err, "Error registering user")
 	}
+	registered = true
 
-	// Simulate sending an email (just print the link)
-	log.Printf("Email verification link: http://localhost:3000/verify/%s\n", user.VerificationToken)
-
-	return c.Status(fiber.StatusCreated).JSON(Response{
-		Status: true,
-		Data:   user, // Include user data in the response
-	})
+	logging.FromCtx(c).Info("User registered", "user_id", user.ID, "email", user.Email)
+	metrics.Outcome(metrics.OutcomeRegistered)
+	event := audit.FromRequest(c, audit.UserRegistered, user.ID)
+	if invitation != nil {
+		event.Details = map[string]string{"invitation_id": invitation.ID.String()}
+	}
+	auditLog.Record(ctx, event)
+	webhooks.Publish(ctx, webhook.UserRegistered, fiber.Map{"user_id": user.ID, "username": user.Username, "email": user.Email})
+	if invitation != nil {
+		webhooks.Publish(ctx, webhook.UserEmailVerified, fiber.Map{"user_id": user.ID, "email": user.Email})
+	}
+	return user, nil
 }
 
 // VerifyEmail verifies the user's email based on the provided token
 func verifyEmail(c *fiber.Ctx) error {
+	ctx := c.UserContext()
 	token := c.Params("token")
 
 	// Find the user with the provided verification token
 	var user User
-	err := session.Query(`SELECT id, username, email, email_verified FROM users WHERE verification_token = ?`, token).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified)
-
+	var tenantID string
+	var expiresAt time.Time
+	err := session.Query(`SELECT id, tenant, username, email, email_verified, verification_token_expires_at FROM users WHERE verification_token = ?`, token).WithContext(ctx).
+		Scan(&user.ID, &tenantID, &user.Username, &user.Email, &user.EmailVerified, &expiresAt)
+	// Tokens are only valid in the tenant of their user
+	if err == nil && tenant.Stored(tenantID) != tenant.FromContext(ctx).ID {
+		err = gocql.ErrNotFound
+	}
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeTokenInvalid, "Invalid token")
+	}
 	if err != nil {
-		if err == gocql.ErrNotFound {
-			return c.Status(fiber.StatusNotFound).JSON(Response{
-				Status:  false,
-				Message: "Invalid token",
-			})
-		}
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error retrieving user",
-		})
+		return response.Internal(err, "Error retrieving user")
+	}
+	if tokenExpired(expiresAt) {
+		return response.New(response.CodeTokenExpired, "Token expired")
 	}
 
 	// Update the user's email_verified status
 	user.EmailVerified = true
-	if err := session.Query(`UPDATE users SET email_verified = ? WHERE id = ?`, user.EmailVerified, user.ID).Exec(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error updating user verification status",
-		})
+	if err := session.Query(`UPDATE users SET email_verified = ? WHERE id = ?`, user.EmailVerified, user.ID).WithContext(ctx).Exec(); err != nil {
+		return response.Internal(err, "Error updating user verification status")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(Response{
-		Status:  true,
-		Message: "Email successfully verified",
-	})
+	metrics.Outcome(metrics.OutcomeEmailVerified)
+	auditLog.Record(ctx, audit.FromRequest(c, audit.EmailVerified, user.ID))
+	webhooks.Publish(ctx, webhook.UserEmailVerified, fiber.Map{"user_id": user.ID, "email": user.Email})
+	return response.Success(c, fiber.StatusOK, "Email successfully verified", nil)
 }
 
 // PasswordRecovery handles the password recovery request
 func recoverPassword(c *fiber.Ctx) error {
+	ctx := c.UserContext()
 	recoverRequest := new(RecoverRequest)
 	if err := c.BodyParser(recoverRequest); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(Response{
-			Status:  false,
-			Message: "Invalid request",
-		})
+		return response.New(response.CodeBadRequest, "Invalid request")
 	}
 
-	email := strings.TrimSpace(recoverRequest.Email)
-	log.Printf("Received email for recovery: %s\n", email) // Debug log
+	email, err := identity.NormalizeEmail(recoverRequest.Email)
+	if err != nil {
+		return response.Invalid(response.Field("email", err))
+	}
+	logging.FromCtx(c).Debug("Received email for recovery", "email", email)
 
 	// Find the user by email
 	var user User
-	err := session.Query(`SELECT id, username, email FROM users WHERE email = ?`, email).Scan(&user.ID, &user.Username, &user.Email)
-
+	var locale string
+	userID, err := lookupUserIDByEmail(ctx, email)
+	if err == nil {
+		err = session.Query(`SELECT id, username, email, locale FROM users WHERE id = ?`, userID).WithContext(ctx).Scan(&user.ID, &user.Username, &user.Email, &locale)
+	}
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeUserNotFound, "Email not found")
+	}
 	if err != nil {
-		if err == gocql.ErrNotFound {
-			return c.Status(fiber.StatusNotFound).JSON(Response{
-				Status:  false,
-				Message: "Email not found",
-				Data:    nil,
-				Error:   nil,
-			})
-		}
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error processing password recovery",
-			Data:    nil,
-			Error: &Error{
-				Message: "Internal server error",
-				Detail:  err.Error(),
-			},
-		})
+		return response.Internal(err, "Error processing password recovery")
 	}
 
 	// Generate a verification token
 	verificationToken := generateToken()
 
 	// Store the verification token in the database
-	err = session.Query(`UPDATE users SET verification_token = ? WHERE id = ?`, verificationToken, user.ID).Exec()
+	err = session.Query(`UPDATE users SET verification_token = ?, verification_token_expires_at = ? WHERE id = ?`,
+		verificationToken, time.Now().Add(recoveryTokenLifetime), user.ID).WithContext(ctx).Exec()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error storing verification token",
-			Data:    nil,
-			Error: &Error{
-				Message: "Internal server error",
-				Detail:  err.Error(),
-			},
-		})
+		return response.Internal(err, "Error storing verification token")
 	}
 
 	// Send email with the verification link
-	err = sendEmail(user.Email, verificationToken)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error sending email",
-			Data:    nil,
-			Error: &Error{
-				Message: "Internal server error",
-				Detail:  err.Error(),
-			},
-		})
-	}
-
-	return c.Status(fiber.StatusOK).JSON(Response{
-		Status:  true,
-		Message: "Password recovery email sent successfully",
-		Data:    nil,
-		Error:   nil,
-	})
+	// The email is written in the user's language, falling back to the request's
+	tag, ok := i18n.Parse(locale)
+	if !ok {
+		tag = i18n.Locale(c)
+	}
+	if err := sendRecoveryEmail(ctx, user.Email, verificationToken, tag); err != nil {
+		return response.Wrap(response.CodeEmailDeliveryFailed, err, "Error sending email")
+	}
+
+	metrics.Outcome(metrics.OutcomeRecoveryRequest)
+	auditLog.Record(ctx, audit.FromRequest(c, audit.RecoveryRequested, user.ID))
+	return response.Success(c, fiber.StatusOK, "Password recovery email sent successfully", nil)
 }
 
 // ResetPassword handles the actual password reset
 func resetPassword(c *fiber.Ctx) error {
+	ctx := c.UserContext()
 	token := c.Params("token")
 	resetRequest := new(ResetRequest)
 	if err := c.BodyParser(resetRequest); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(Response{
-			Status:  false,
-			Message: "Invalid request",
-		})
+		return response.New(response.CodeBadRequest, "Invalid request")
 	}
 
 	newPassword := resetRequest.Password
+	t := tenant.FromContext(ctx)
+	if err := validatePassword(i18n.Locale(c), t.PasswordMinLength, newPassword); err != nil {
+		return response.Invalid(response.Field("password", err))
+	}
 
-	// Find the user by verification token
+	// Find the user by verification token, which is only valid in the user's tenant
 	var user User
-	err := session.Query(`SELECT id, username FROM users WHERE verification_token = ?`, token).Scan(&user.ID, &user.Username)
-
+	var tenantID string
+	var expiresAt time.Time
+	err := session.Query(`SELECT id, tenant, username, verification_token_expires_at FROM users WHERE verification_token = ?`, token).WithContext(ctx).
+		Scan(&user.ID, &tenantID, &user.Username, &expiresAt)
+	if err == nil && tenant.Stored(tenantID) != t.ID {
+		err = gocql.ErrNotFound
+	}
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeTokenInvalid, "Invalid token")
+	}
 	if err != nil {
-		if err == gocql.ErrNotFound {
-			return c.Status(fiber.StatusNotFound).JSON(Response{
-				Status:  false,
-				Message: "Invalid token",
-				Data:    nil,
-				Error:   nil,
-			})
-		}
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error processing password reset",
-			Data:    nil,
-			Error: &Error{
-				Message: "Internal server error",
-				Detail:  err.Error(),
-			},
-		})
+		return response.Internal(err, "Error processing password reset")
+	}
+	if tokenExpired(expiresAt) {
+		return response.New(response.CodeTokenExpired, "Token expired")
 	}
 
 	// Update the user's password (ensure you hash the password before storing it)
-	hashedPassword, err := hashPassword(newPassword)
+	hashedPassword, err := hashPassword(ctx, newPassword)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error hashing password",
-			Data:    nil,
-			Error: &Error{
-				Message: "Internal server error",
-				Detail:  err.Error(),
-			},
-		})
+		return response.Internal(err, "Error hashing password")
 	}
 
 	// Update the password and clear the verification token
-	err = session.Query(`UPDATE users SET password = ?, verification_token = null WHERE id = ?`, hashedPassword, user.ID).Exec()
+	err = session.Query(`UPDATE users SET password = ?, verification_token = null, verification_token_expires_at = null WHERE id = ?`, hashedPassword, user.ID).WithContext(ctx).Exec()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{
-			Status:  false,
-			Message: "Error updating password",
-			Data:    nil,
-			Error: &Error{
-				Message: "Internal server error",
-				Detail:  err.Error(),
-			},
-		})
-	}
-
-	return c.Status(fiber.StatusOK).JSON(Response{
-		Status:  true,
-		Message: "Password successfully reset",
-		Data:    nil,
-		Error:   nil,
-	})
+		return response.Internal(err, "Error updating password")
+	}
+
+	metrics.Outcome(metrics.OutcomePasswordReset)
+	auditLog.Record(ctx, audit.FromRequest(c, audit.PasswordReset, user.ID))
+	webhooks.Publish(ctx, webhook.UserPasswordReset, fiber.Map{"user_id": user.ID})
+	return response.Success(c, fiber.StatusOK, "Password successfully reset", nil)
 }
 
 // Generate a random token (for email verification and password reset)
@@ -343,89 +543,46 @@ func generateToken() string {
 	return hex.EncodeToString(token)
 }
 
-// sendEmail sends a password recovery email using an external SMTP server.
-func sendEmail(to, token string) error {
-	// Create the recovery link
-	recoveryLink := fmt.Sprintf("http://localhost:3000/password/reset/%s", token) // Adjust URL as necessary
-
-	// Log email details for debugging
-	log.Printf("Sending password recovery email to: %s\nLink: %s\n", to, recoveryLink)
-
-	// Get sender's email from environment variables
-	senderEmail := os.Getenv("SMTP_SENDER_EMAIL")
-	if senderEmail == "" {
-		log.Println("Error: SMTP_SENDER_EMAIL is not set")
-		return fmt.Errorf("SMTP_SENDER_EMAIL is not set")
-	}
-	log.Printf("Sender email: %s\n", senderEmail)
-
-	// Log recipient's email
-	log.Printf("Recipient email: %s\n", to)
-	if to == "" {
-		return fmt.Errorf("recipient email is empty")
-	}
-
-	// Set up Gomail
-	m := gomail.NewMessage()
-
-	// Set the sender's email address
-	m.SetHeader("From", senderEmail)
-
-	// Set the recipient's email address
-	m.SetHeader("To", to)
-
-	// Set the subject of the email
-	m.SetHeader("Subject", "Password Recovery")
-
-	// Set the body of the email (HTML or plain text)
-	m.SetBody("text/html", fmt.Sprintf(`
-        <h1>Password Recovery</h1>
-        <p>You have requested to reset your password. Please click the following link to reset your password:</p>
-        <a href="%s">Reset Password</a>
-    `, recoveryLink))
-
-	// Use an external SMTP server to send the email
-	d := gomail.NewDialer(
-		os.Getenv("SMTP_HOST"),        // SMTP server host (e.g., smtp.example.com)
-		getEnvAsInt("SMTP_PORT", 587), // SMTP server port (default: 587)
-		os.Getenv("SMTP_USERNAME"),    // SMTP server username
-		os.Getenv("SMTP_PASSWORD"),    // SMTP server password
-	)
-
-	// Set TLS configuration (useful for enforcing TLS)
-	d.TLSConfig = &tls.Config{
-		InsecureSkipVerify: false,            // Set this to true only for self-signed certificates in development
-		MinVersion:         tls.VersionTLS12, // Enforce a minimum version of TLS (e.g., TLS 1.2)
-	}
-
-	// Send the email
-	if err := d.DialAndSend(m); err != nil {
-		log.Printf("Failed to send email to %s: %v\n", to, err)
-		return err
-	}
-
-	log.Printf("Password recovery email successfully sent to %s\n", to)
-	return nil
+// sendVerificationEmail sends an email verification link in the language tag
+func sendVerificationEmail(ctx context.Context, to, token string, tag language.Tag) error {
+	verificationLink := fmt.Sprintf("%s/verify/%s", tenant.FromContext(ctx).PublicURL, token)
+
+	subject := i18n.Translate(tag, "Verify your email address")
+	body := fmt.Sprintf(`
+        <h1>%s</h1>
+        <p>%s</p>
+        <a href="%s">%s</a>
+    `, html.EscapeString(subject),
+		html.EscapeString(fmt.Sprintf(i18n.Translate(tag, "Please click the following link to verify your email address. It expires in %d hours."), int(verificationTokenLifetime.Hours()))),
+		verificationLink,
+		html.EscapeString(i18n.Translate(tag, "Verify email address")))
+
+	return mailer.Send(ctx, to, subject, body)
 }
 
-// Utility function to retrieve environment variables as integers
-func getEnvAsInt(name string, defaultValue int) int {
-	valueStr := os.Getenv(name)
-	if valueStr == "" {
-		return defaultValue
-	}
-
-	value, err := strconv.Atoi(valueStr)
-	if err != nil {
-		log.Printf("Error parsing environment variable %s: %v. Using default value: %d", name, err, defaultValue)
-		return defaultValue
-	}
-
-	return value
+// sendRecoveryEmail sends a password recovery link in the language tag
+func sendRecoveryEmail(ctx context.Context, to, token string, tag language.Tag) error {
+	// Create the recovery link
+	recoveryLink := fmt.Sprintf("%s/password/reset/%s", tenant.FromContext(ctx).PublicURL, token)
+
+	subject := i18n.Translate(tag, "Password Recovery")
+	body := fmt.Sprintf(`
+        <h1>%s</h1>
+        <p>%s</p>
+        <a href="%s">%s</a>
+    `, html.EscapeString(subject),
+		html.EscapeString(i18n.Translate(tag, "You have requested to reset your password. Please click the following link to reset your password:")),
+		recoveryLink,
+		html.EscapeString(i18n.Translate(tag, "Reset Password")))
+
+	return mailer.Send(ctx, to, subject, body)
 }
 
 // hashPassword takes a plain password as input and returns its bcrypt hashed version.
-func hashPassword(password string) (string, error) {
+func hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracing.Start(ctx, "auth.hashPassword")
+	defer span.End()
+	defer metrics.ObserveSince(metrics.PasswordHashDuration, time.Now(), "hash")
 	// Use bcrypt to generate a hashed password with a cost of bcrypt.DefaultCost (currently 10)
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
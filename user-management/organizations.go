@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/caller"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The /orgs routes are guarded by caller.Middleware. Organizations are only
+// visible to their members; to anyone else they do not exist. Changes to
+// memberships reach access tokens when they are next refreshed.
+
+// Organization roles, see roleRank
+const (
+	roleOwner  = "owner"
+	roleAdmin  = "admin"
+	roleMember = "member"
+)
+
+// roleRank orders the roles by privilege. Members may only grant roles up to
+// their own, and only owners may change or remove owners.
+var roleRank = map[string]int{roleMember: 1, roleAdmin: 2, roleOwner: 3}
+
+// orgNameMaxLength bounds the names of organizations
+const orgNameMaxLength = 100
+
+// Organization is an organization as seen by one of its members
+type Organization struct {
+	ID        gocql.UUID `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	// Role is the caller's role in the organization
+	Role    string   `json:"role"`
+	Members []Member `json:"members,omitempty"`
+}
+
+// Member is a user's membership of an organization
+type Member struct {
+	UserID   gocql.UUID `json:"user_id"`
+	Role     string     `json:"role"`
+	JoinedAt time.Time  `json:"joined_at"`
+}
+
+// OrganizationRequest is the body accepted when creating an organization
+type OrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+// RoleRequest is the body accepted when changing a member's role
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// createOrganization creates an organization owned by the caller
+func createOrganization(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	userID := caller.From(c).UserID
+	request := new(OrganizationRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len([]rune(request.Name)) > orgNameMaxLength {
+		return response.Invalid(response.FieldError{Field: "name", Code: response.CodeFieldOutOfRange, Message: "name must be 1 to 100 characters"})
+	}
+	// Names end up in email subjects
+	if strings.ContainsFunc(request.Name, unicode.IsControl) {
+		return response.Invalid(response.FieldError{Field: "name", Code: response.CodeFieldFormat, Message: "name must not contain control characters"})
+	}
+
+	org := Organization{ID: gocql.TimeUUID(), Name: request.Name, CreatedAt: time.Now(), Role: roleOwner}
+	err := session.Query(`INSERT INTO organizations (id, tenant, name, created_at) VALUES (?, ?, ?, ?)`,
+		org.ID, tenant.FromContext(ctx).ID, org.Name, org.CreatedAt).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error creating organization")
+	}
+	if err := addMember(ctx, org.ID, userID, roleOwner); err != nil {
+		return response.Internal(err, "Error creating organization")
+	}
+
+	event := audit.FromRequest(c, audit.OrgCreated, userID)
+	event.Details = map[string]string{"org_id": org.ID.String(), "name": org.Name}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusCreated, "", org)
+}
+
+// listOrganizations lists the organizations the caller is a member of
+func listOrganizations(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	orgs := []Organization{}
+	var (
+		orgID gocql.UUID
+		role  string
+	)
+	iter := session.Query(`SELECT org_id, role FROM organization_memberships_by_user WHERE user_id = ?`, caller.From(c).UserID).WithContext(ctx).Iter()
+	for iter.Scan(&orgID, &role) {
+		org, err := loadOrganization(ctx, orgID)
+		if err == gocql.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			iter.Close()
+			return response.Internal(err, "Error listing organizations")
+		}
+		org.Role = role
+		orgs = append(orgs, org)
+	}
+	if err := iter.Close(); err != nil {
+		return response.Internal(err, "Error listing organizations")
+	}
+
+	return response.Success(c, fiber.StatusOK, "", orgs)
+}
+
+// getOrganization returns an organization with its members
+func getOrganization(c *fiber.Ctx) error {
+	org, err := callerOrganization(c)
+	if err != nil {
+		return err
+	}
+	if org.Members, err = listMembers(c.UserContext(), org.ID); err != nil {
+		return response.Internal(err, "Error retrieving organization")
+	}
+
+	return response.Success(c, fiber.StatusOK, "", org)
+}
+
+// deleteOrganization deletes an organization with its memberships and
+// pending invitations. Only owners may do so.
+func deleteOrganization(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	org, err := callerOrganization(c)
+	if err != nil {
+		return err
+	}
+	if org.Role != roleOwner {
+		return response.New(response.CodeForbidden, "Only owners can delete an organization")
+	}
+
+	if err := dissolveOrganization(ctx, org.ID); err != nil {
+		return response.Internal(err, "Error deleting organization")
+	}
+
+	event := audit.FromRequest(c, audit.OrgDeleted, caller.From(c).UserID)
+	event.Details = map[string]string{"org_id": org.ID.String(), "name": org.Name}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusOK, "Organization deleted", nil)
+}
+
+// updateMember changes the role of a member
+func updateMember(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	request := new(RoleRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	if _, ok := roleRank[request.Role]; !ok {
+		return response.Invalid(response.FieldError{Field: "role", Code: response.CodeFieldNotAllowed, Message: "role must be owner, admin or member"})
+	}
+	org, target, err := callerTarget(c)
+	if err != nil {
+		return err
+	}
+	if roleRank[org.Role] < roleRank[roleAdmin] || !mayManage(org.Role, target.Role) || !mayManage(org.Role, request.Role) {
+		return response.New(response.CodeForbidden, "You cannot change this member's role")
+	}
+	if target.Role == roleOwner && request.Role != roleOwner {
+		if err := ensureAnotherOwner(ctx, org.ID, target.UserID); err != nil {
+			return err
+		}
+	}
+
+	if err := setMemberRole(ctx, org.ID, target.UserID, request.Role); err != nil {
+		return response.Internal(err, "Error updating member")
+	}
+
+	// The event belongs to the member, the caller is who changed the role
+	event := audit.FromRequest(c, audit.OrgRoleChanged, target.UserID)
+	event.Actor = caller.From(c).UserID.String()
+	event.Details = map[string]string{"org_id": org.ID.String(), "role": request.Role, "previous_role": target.Role}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusOK, "Member updated", nil)
+}
+
+// deleteMember removes a member from an organization. Members may always
+// leave, except for the last owner.
+func deleteMember(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	org, target, err := callerTarget(c)
+	if err != nil {
+		return err
+	}
+	userID := caller.From(c).UserID
+	if target.UserID != userID && (roleRank[org.Role] < roleRank[roleAdmin] || !mayManage(org.Role, target.Role)) {
+		return response.New(response.CodeForbidden, "You cannot remove this member")
+	}
+	if target.Role == roleOwner {
+		if err := ensureAnotherOwner(ctx, org.ID, target.UserID); err != nil {
+			return err
+		}
+	}
+
+	if err := removeMember(ctx, org.ID, target.UserID); err != nil {
+		return response.Internal(err, "Error removing member")
+	}
+
+	event := audit.FromRequest(c, audit.OrgMemberRemoved, target.UserID)
+	event.Actor = userID.String()
+	event.Details = map[string]string{"org_id": org.ID.String()}
+	auditLog.Record(ctx, event)
+	return response.Success(c, fiber.StatusOK, "Member removed", nil)
+}
+
+// callerOrganization loads the organization in the :id parameter along with
+// the caller's role in it. The returned error is ready to be returned by a
+// handler.
+func callerOrganization(c *fiber.Ctx) (Organization, error) {
+	ctx := c.UserContext()
+	orgID, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return Organization{}, response.New(response.CodeBadRequest, "Invalid organization ID")
+	}
+	org, err := loadOrganization(ctx, orgID)
+	if err == nil {
+		org.Role, err = memberRole(ctx, orgID, caller.From(c).UserID)
+	}
+	if err == gocql.ErrNotFound {
+		return Organization{}, response.New(response.CodeNotFound, "Organization not found")
+	}
+	if err != nil {
+		return Organization{}, response.Internal(err, "Error retrieving organization")
+	}
+	return org, nil
+}
+
+// callerTarget is callerOrganization for routes that act on the member in
+// the :user_id parameter
+func callerTarget(c *fiber.Ctx) (Organization, Member, error) {
+	org, err := callerOrganization(c)
+	if err != nil {
+		return Organization{}, Member{}, err
+	}
+	target := Member{}
+	if target.UserID, err = gocql.ParseUUID(c.Params("user_id")); err != nil {
+		return Organization{}, Member{}, response.New(response.CodeBadRequest, "Invalid user ID")
+	}
+	target.Role, err = memberRole(c.UserContext(), org.ID, target.UserID)
+	if err == gocql.ErrNotFound {
+		return Organization{}, Member{}, response.New(response.CodeNotFound, "Member not found")
+	}
+	if err != nil {
+		return Organization{}, Member{}, response.Internal(err, "Error retrieving member")
+	}
+	return org, target, nil
+}
+
+// mayManage reports whether a member with role may grant, change or remove
+// the role other
+func mayManage(role, other string) bool {
+	return roleRank[role] >= roleRank[other]
+}
+
+// ensureAnotherOwner returns an error ready to be returned by a handler
+// unless the organization has an owner besides userID
+func ensureAnotherOwner(ctx context.Context, orgID, userID gocql.UUID) error {
+	members, err := listMembers(ctx, orgID)
+	if err != nil {
+		return response.Internal(err, "Error retrieving members")
+	}
+	for _, member := range members {
+		if member.Role == roleOwner && member.UserID != userID {
+			return nil
+		}
+	}
+	return response.New(response.CodeLastOwner, "An organization needs at least one owner")
+}
+
+// dissolveOrganization deletes orgID with its memberships and pending
+// invitations
+func dissolveOrganization(ctx context.Context, orgID gocql.UUID) error {
+	members, err := listMembers(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if err := removeMember(ctx, orgID, member.UserID); err != nil {
+			return err
+		}
+	}
+	invitations, err := listPendingInvitations(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, invitation := range invitations {
+		if err := deleteInvitation(ctx, orgID, invitation.ID, invitation.tokenHash); err != nil {
+			return err
+		}
+	}
+	return session.Query(`DELETE FROM organizations WHERE id = ?`, orgID).WithContext(ctx).Exec()
+}
+
+// loadOrganization returns the organization orgID if it belongs to the
+// tenant in ctx, or gocql.ErrNotFound
+func loadOrganization(ctx context.Context, orgID gocql.UUID) (Organization, error) {
+	org := Organization{ID: orgID}
+	var tenantID string
+	err := session.Query(`SELECT tenant, name, created_at FROM organizations WHERE id = ?`, orgID).WithContext(ctx).
+		Scan(&tenantID, &org.Name, &org.CreatedAt)
+	if err != nil {
+		return Organization{}, err
+	}
+	if tenantID != tenant.FromContext(ctx).ID {
+		return Organization{}, gocql.ErrNotFound
+	}
+	return org, nil
+}
+
+// memberRole returns the role of userID in orgID, or gocql.ErrNotFound
+func memberRole(ctx context.Context, orgID, userID gocql.UUID) (string, error) {
+	var role string
+	err := session.Query(`SELECT role FROM organization_members WHERE org_id = ? AND user_id = ?`, orgID, userID).WithContext(ctx).Scan(&role)
+	return role, err
+}
+
+// listMembers returns the members of orgID
+func listMembers(ctx context.Context, orgID gocql.UUID) ([]Member, error) {
+	var members []Member
+	var member Member
+	iter := session.Query(`SELECT user_id, role, joined_at FROM organization_members WHERE org_id = ?`, orgID).WithContext(ctx).Iter()
+	for iter.Scan(&member.UserID, &member.Role, &member.JoinedAt) {
+		members = append(members, member)
+	}
+	return members, iter.Close()
+}
+
+// listMemberships returns the organizations userID is a member of, with
+// only their ID and the user's role filled in
+func listMemberships(ctx context.Context, userID gocql.UUID) ([]Organization, error) {
+	var orgs []Organization
+	var org Organization
+	iter := session.Query(`SELECT org_id, role FROM organization_memberships_by_user WHERE user_id = ?`, userID).WithContext(ctx).Iter()
+	for iter.Scan(&org.ID, &org.Role) {
+		orgs = append(orgs, org)
+	}
+	return orgs, iter.Close()
+}
+
+// addMember makes userID a member of orgID with role
+func addMember(ctx context.Context, orgID, userID gocql.UUID, role string) error {
+	err := session.Query(`INSERT INTO organization_members (org_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)`,
+		orgID, userID, role, time.Now()).WithContext(ctx).Exec()
+	if err != nil {
+		return err
+	}
+	return session.Query(`INSERT INTO organization_memberships_by_user (user_id, org_id, role) VALUES (?, ?, ?)`,
+		userID, orgID, role).WithContext(ctx).Exec()
+}
+
+// setMemberRole changes the role of an existing member
+func setMemberRole(ctx context.Context, orgID, userID gocql.UUID, role string) error {
+	err := session.Query(`UPDATE organization_members SET role = ? WHERE org_id = ? AND user_id = ?`, role, orgID, userID).WithContext(ctx).Exec()
+	if err != nil {
+		return err
+	}
+	return session.Query(`UPDATE organization_memberships_by_user SET role = ? WHERE user_id = ? AND org_id = ?`, role, userID, orgID).WithContext(ctx).Exec()
+}
+
+// removeMember ends the membership of userID in orgID and revokes the
+// pending invitations they sent, which would otherwise outlive their access
+func removeMember(ctx context.Context, orgID, userID gocql.UUID) error {
+	// The claim goes first, so that a failure leaves no access behind
+	err := session.Query(`DELETE FROM organization_memberships_by_user WHERE user_id = ? AND org_id = ?`, userID, orgID).WithContext(ctx).Exec()
+	if err != nil {
+		return err
+	}
+	if err := session.Query(`DELETE FROM organization_members WHERE org_id = ? AND user_id = ?`, orgID, userID).WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+
+	invitations, err := listPendingInvitations(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, invitation := range invitations {
+		if invitation.InvitedBy != userID {
+			continue
+		}
+		if err := deleteInvitation(ctx, orgID, invitation.ID, invitation.tokenHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
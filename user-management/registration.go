@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"slices"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/auth"
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/logging"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
+)
+
+// Admins invite people to register by email, with the roles their account
+// will have. Invitations can be used whether or not registration is open,
+// until they expire after cfg.Registration.InvitationTTL. Only the hash of a
+// token is stored.
+
+// UserInvitation is a pending invitation to register, without its token
+type UserInvitation struct {
+	ID        gocql.UUID `json:"id"`
+	Email     string     `json:"email"`
+	Roles     []string   `json:"roles"`
+	ExpiresAt time.Time  `json:"expires_at"`
+
+	tokenHash string
+}
+
+// UserInvitationRequest is the body accepted when inviting someone to register
+type UserInvitationRequest struct {
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+}
+
+// InvitedRegisterRequest is the body accepted by /register/invitation/:token;
+// the email address is the invited one
+type InvitedRegisterRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Locale   string `json:"locale"`
+}
+
+// createUserInvitation invites an email address to register in the tenant of
+// the request
+func createUserInvitation(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	request := new(UserInvitationRequest)
+	if err := c.BodyParser(request); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	email, err := identity.NormalizeEmail(request.Email)
+	if err != nil {
+		return response.Invalid(response.Field("email", err))
+	}
+	slices.Sort(request.Roles)
+	request.Roles = slices.Compact(request.Roles)
+	if request.Roles == nil {
+		request.Roles = []string{}
+	}
+
+	// Invitations to registered addresses could never be used
+	_, err = lookupUserIDByEmail(ctx, email)
+	if err == nil {
+		return response.New(response.CodeEmailTaken, "Email already exists")
+	}
+	if err != gocql.ErrNotFound {
+		return response.Internal(err, "Error creating invitation")
+	}
+
+	token, err := auth.GenerateBase64RandomToken(43)
+	if err != nil {
+		return response.Internal(err, "Error creating invitation")
+	}
+	t := tenant.FromContext(ctx)
+	invitation := UserInvitation{
+		ID:        gocql.TimeUUID(),
+		Email:     email,
+		Roles:     request.Roles,
+		ExpiresAt: time.Now().Add(cfg.Registration.InvitationTTL),
+		tokenHash: hashToken(token),
+	}
+	ttl := int(cfg.Registration.InvitationTTL.Seconds())
+	err = session.Query(`INSERT INTO user_invitations_by_tenant (tenant, id, token_hash, email, roles, expires_at) VALUES (?, ?, ?, ?, ?, ?) USING TTL ?`,
+		t.ID, invitation.ID, invitation.tokenHash, invitation.Email, invitation.Roles, invitation.ExpiresAt, ttl).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error creating invitation")
+	}
+	err = session.Query(`INSERT INTO user_invitations (token_hash, id, tenant, email, roles, expires_at) VALUES (?, ?, ?, ?, ?, ?) USING TTL ?`,
+		invitation.tokenHash, invitation.ID, t.ID, invitation.Email, invitation.Roles, invitation.ExpiresAt, ttl).WithContext(ctx).Exec()
+	if err != nil {
+		return response.Internal(err, "Error creating invitation")
+	}
+
+	// An invitation that never arrived is withdrawn, so that it can be sent again
+	if err := sendUserInvitationEmail(ctx, email, token, i18n.Locale(c)); err != nil {
+		if err := deleteUserInvitation(ctx, invitation.ID, invitation.tokenHash); err != nil {
+			return response.Internal(err, "Error withdrawing invitation")
+		}
+		return response.Wrap(response.CodeEmailDeliveryFailed, err, "Error sending email")
+	}
+
+	logging.FromCtx(c).Info("User invitation sent", "invitation_id", invitation.ID, "email", invitation.Email, "roles", invitation.Roles)
+	return response.Success(c, fiber.StatusCreated, "", invitation)
+}
+
+// listUserInvitations lists the pending invitations of the tenant, newest first
+func listUserInvitations(c *fiber.Ctx) error {
+	invitations := []UserInvitation{}
+	var invitation UserInvitation
+	iter := session.Query(`SELECT id, email, roles, expires_at FROM user_invitations_by_tenant WHERE tenant = ?`, tenant.FromContext(c.UserContext()).ID).
+		WithContext(c.UserContext()).Iter()
+	for iter.Scan(&invitation.ID, &invitation.Email, &invitation.Roles, &invitation.ExpiresAt) {
+		if invitation.Roles == nil {
+			invitation.Roles = []string{}
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err := iter.Close(); err != nil {
+		return response.Internal(err, "Error listing invitations")
+	}
+
+	return response.Success(c, fiber.StatusOK, "", invitations)
+}
+
+// revokeUserInvitation withdraws a pending invitation
+func revokeUserInvitation(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return response.New(response.CodeBadRequest, "Invalid invitation ID")
+	}
+
+	var tokenHash string
+	err = session.Query(`SELECT token_hash FROM user_invitations_by_tenant WHERE tenant = ? AND id = ?`, tenant.FromContext(ctx).ID, id).WithContext(ctx).Scan(&tokenHash)
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeNotFound, "Invitation not found")
+	}
+	if err != nil {
+		return response.Internal(err, "Error revoking invitation")
+	}
+	if err := deleteUserInvitation(ctx, id, tokenHash); err != nil {
+		return response.Internal(err, "Error revoking invitation")
+	}
+
+	logging.FromCtx(c).Info("User invitation revoked", "invitation_id", id)
+	return response.Success(c, fiber.StatusOK, "Invitation revoked", nil)
+}
+
+// getUserInvitation returns the invitation with the token, so that the
+// registration form can show the invited address
+func getUserInvitation(c *fiber.Ctx) error {
+	invitation, err := findUserInvitation(c.UserContext(), c.Params("token"))
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeTokenInvalid, "Invalid or expired invitation")
+	}
+	if err != nil {
+		return response.Internal(err, "Error retrieving invitation")
+	}
+
+	return response.Success(c, fiber.StatusOK, "", fiber.Map{"email": invitation.Email, "expires_at": invitation.ExpiresAt})
+}
+
+// registerInvitedUser creates the account of an invited user. The invitation
+// is used up once the account exists; the email claim keeps it from being
+// used twice meanwhile.
+func registerInvitedUser(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	body := new(InvitedRegisterRequest)
+	if err := c.BodyParser(body); err != nil {
+		return response.New(response.CodeBadRequest, "Invalid request")
+	}
+	invitation, err := findUserInvitation(ctx, c.Params("token"))
+	if err == gocql.ErrNotFound {
+		return response.New(response.CodeTokenInvalid, "Invalid or expired invitation")
+	}
+	if err != nil {
+		return response.Internal(err, "Error registering user")
+	}
+
+	request := &RegisterRequest{Username: body.Username, Email: invitation.Email, Password: body.Password, Locale: body.Locale}
+	user, err := createUser(c, request, &invitation)
+	if err != nil {
+		return err
+	}
+	if err := deleteUserInvitation(ctx, invitation.ID, invitation.tokenHash); err != nil {
+		logging.FromCtx(c).Error("Error deleting used invitation", "invitation_id", invitation.ID, "error", err)
+	}
+
+	return response.Success(c, fiber.StatusCreated, "", user)
+}
+
+// findUserInvitation returns the invitation with token. Unknown and expired
+// invitations, and invitations to other tenants, yield gocql.ErrNotFound.
+func findUserInvitation(ctx context.Context, token string) (UserInvitation, error) {
+	invitation := UserInvitation{tokenHash: hashToken(token)}
+	var tenantID string
+	err := session.Query(`SELECT id, tenant, email, roles, expires_at FROM user_invitations WHERE token_hash = ?`, invitation.tokenHash).WithContext(ctx).
+		Scan(&invitation.ID, &tenantID, &invitation.Email, &invitation.Roles, &invitation.ExpiresAt)
+	if err != nil {
+		return UserInvitation{}, err
+	}
+	// The TTL may not have removed the row yet
+	if tenantID != tenant.FromContext(ctx).ID || time.Now().After(invitation.ExpiresAt) {
+		return UserInvitation{}, gocql.ErrNotFound
+	}
+	return invitation, nil
+}
+
+// deleteUserInvitation removes both rows of an invitation of the tenant in ctx
+func deleteUserInvitation(ctx context.Context, id gocql.UUID, tokenHash string) error {
+	if err := session.Query(`DELETE FROM user_invitations WHERE token_hash = ?`, tokenHash).WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	return session.Query(`DELETE FROM user_invitations_by_tenant WHERE tenant = ? AND id = ?`, tenant.FromContext(ctx).ID, id).WithContext(ctx).Exec()
+}
+
+// sendUserInvitationEmail sends an invitation to register in the language tag
+func sendUserInvitationEmail(ctx context.Context, to, token string, tag language.Tag) error {
+	link := fmt.Sprintf("%s/register/invitation/%s", tenant.FromContext(ctx).PublicURL, token)
+
+	subject := i18n.Translate(tag, "You have been invited to create an account")
+	body := fmt.Sprintf(`
+        <h1>%s</h1>
+        <p>%s</p>
+        <a href="%s">%s</a>
+    `, html.EscapeString(subject),
+		html.EscapeString(fmt.Sprintf(i18n.Translate(tag, "Click the following link to choose a username and password. It expires in %d days."), int(cfg.Registration.InvitationTTL.Hours()/24))),
+		link,
+		html.EscapeString(i18n.Translate(tag, "Create account")))
+
+	return mailer.Send(ctx, to, subject, body)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/audit"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tenant"
+	"github.com/bdobrica/LLMDesignedApp/go-common/tracing"
+	"github.com/gocql/gocql"
+)
+
+// SweepResult reports how many rows a sweep removed
+type SweepResult struct {
+	ExpiredVerificationTokens int
+	UnverifiedAccounts        int
+	DeletedAccounts           int
+}
+
+// runSweeper sweeps once right away and then on every interval until ctx is done
+func runSweeper(ctx context.Context, interval, unverifiedMaxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := sweep(ctx, unverifiedMaxAge)
+		if err != nil {
+			slog.Error("Sweeper failed", "error", err)
+		} else {
+			slog.Info("Sweeper finished",
+				"expired_verification_tokens", result.ExpiredVerificationTokens,
+				"unverified_accounts", result.UnverifiedAccounts,
+				"deleted_accounts", result.DeletedAccounts)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep clears verification tokens past their expiry, deletes accounts that
+// were never verified within unverifiedMaxAge of being created, unless a
+// directory or an external identity vouches for them, and carries out the
+// deletions users asked for once their grace period is over
+func sweep(ctx context.Context, unverifiedMaxAge time.Duration) (result SweepResult, err error) {
+	ctx, span := tracing.Start(ctx, "sweeper.sweep")
+	defer func() { tracing.End(span, err) }()
+
+	now := time.Now()
+
+	var (
+		id                  gocql.UUID
+		tenantID            string
+		username            string
+		email               string
+		emailVerified       bool
+		authSource          string
+		verificationToken   string
+		expiresAt           time.Time
+		createdAt           time.Time
+		deletionScheduledAt time.Time
+	)
+	iter := session.Query(`SELECT id, tenant, username, email, email_verified, auth_source, verification_token, verification_token_expires_at, created_at, deletion_scheduled_at FROM users`).
+		WithContext(ctx).PageSize(500).Iter()
+	for iter.Scan(&id, &tenantID, &username, &email, &emailVerified, &authSource, &verificationToken, &expiresAt, &createdAt, &deletionScheduledAt) {
+		// Accounts are deleted in their tenant, which may no longer be configured
+		deleting := ""
+		switch {
+		case !deletionScheduledAt.IsZero() && now.After(deletionScheduledAt):
+			deleting = "requested"
+		case !emailVerified && authSource == "" && !createdAt.IsZero() && now.Sub(createdAt) > unverifiedMaxAge:
+			// Accounts created on sign-in with a directory or provider
+			// cannot be verified by email; those vouch for them instead
+			federated, err := hasIdentities(ctx, id)
+			if err != nil {
+				slog.Error("Error listing identities", "user_id", id, "error", err)
+				continue
+			}
+			if !federated {
+				deleting = "unverified"
+			}
+		}
+		if deleting != "" {
+			t, ok := tenants.Get(tenantID)
+			if !ok {
+				t = &tenant.Tenant{ID: tenant.Stored(tenantID)}
+			}
+			account := Account{ID: id, Tenant: t.ID, Username: username, Email: email, CreatedAt: createdAt}
+			if err := deleteAccount(tenant.NewContext(ctx, t), account, audit.ActorSystem, deleting); err != nil {
+				slog.Error("Error deleting account", "user_id", id, "reason", deleting, "error", err)
+				continue
+			}
+			if deleting == "unverified" {
+				result.UnverifiedAccounts++
+			} else {
+				result.DeletedAccounts++
+			}
+			continue
+		}
+
+		if verificationToken == "" {
+			continue
+		}
+		// Tokens issued before expiries were recorded fall back to the account age
+		if expiresAt.IsZero() {
+			expiresAt = createdAt.Add(verificationTokenLifetime)
+		}
+		if now.After(expiresAt) {
+			if err := session.Query(`UPDATE users SET verification_token = null, verification_token_expires_at = null WHERE id = ?`, id).WithContext(ctx).Exec(); err != nil {
+				slog.Error("Error clearing verification token", "user_id", id, "error", err)
+				continue
+			}
+			result.ExpiredVerificationTokens++
+		}
+	}
+
+	return result, iter.Close()
+}
+
+// hasIdentities reports whether userID is linked to an external identity
+func hasIdentities(ctx context.Context, userID gocql.UUID) (bool, error) {
+	var provider string
+	err := session.Query(`SELECT provider FROM user_identities_by_user WHERE user_id = ? LIMIT 1`, userID).WithContext(ctx).Scan(&provider)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// tokenExpired reports whether a token with the given expiry can no longer be used.
+// A zero expiry means the token predates expiry tracking and is still accepted.
+func tokenExpired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && time.Now().After(expiresAt)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bdobrica/LLMDesignedApp/go-common/i18n"
+	"github.com/bdobrica/LLMDesignedApp/go-common/identity"
+	"github.com/bdobrica/LLMDesignedApp/go-common/response"
+	"golang.org/x/text/language"
+)
+
+// Password length limits; bcrypt ignores everything past 72 bytes. Tenants
+// may require longer passwords than passwordMinLength.
+const (
+	passwordMinLength = 8
+	passwordMaxBytes  = 72
+)
+
+var (
+	errPasswordTooLong    = identity.NewError(string(response.CodePasswordTooLong), "password must be at most 72 bytes long")
+	errLocaleNotSupported = identity.NewError(string(response.CodeLocaleUnsupported), "locale is not supported")
+)
+
+// Validate normalizes the username, email and locale in place and returns one
+// entry per invalid field. Passwords must have at least minLength characters;
+// that message is written in the language tag, as it cannot be looked up
+// once formatted.
+func (r *RegisterRequest) Validate(tag language.Tag, minLength int) []response.FieldError {
+	var fields []response.FieldError
+
+	username, err := identity.NormalizeUsername(r.Username)
+	if err != nil {
+		fields = append(fields, response.Field("username", err))
+	}
+	r.Username = username
+
+	email, err := identity.NormalizeEmail(r.Email)
+	if err != nil {
+		fields = append(fields, response.Field("email", err))
+	}
+	r.Email = email
+
+	if err := validatePassword(tag, minLength, r.Password); err != nil {
+		fields = append(fields, response.Field("password", err))
+	}
+
+	if r.Locale != "" {
+		tag, ok := i18n.Parse(r.Locale)
+		if !ok {
+			fields = append(fields, response.Field("locale", errLocaleNotSupported))
+		}
+		r.Locale = tag.String()
+	}
+	return fields
+}
+
+// validatePassword checks the length of a new password against minLength
+// and the bcrypt limit, with messages in the language tag. Passwords are not
+// normalized, so they are compared byte for byte.
+func validatePassword(tag language.Tag, minLength int, password string) error {
+	if len([]rune(password)) < minLength {
+		return identity.NewError(string(response.CodePasswordTooShort), fmt.Sprintf(i18n.Translate(tag, "password must be at least %d characters long"), minLength))
+	}
+	if len(password) > passwordMaxBytes {
+		return errPasswordTooLong
+	}
+	return nil
+}